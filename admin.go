@@ -0,0 +1,412 @@
+package gapless
+
+import (
+    "context"
+    "crypto/subtle"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "net/http"
+    "sort"
+    "strconv"
+    "sync"
+    "sync/atomic"
+    "time"
+)
+
+// How long an admin request may wait on connections in use, unless it says.
+const adminTimeout = 30 * time.Second
+
+// What the admin API can get at while an app runs.
+type appRuntime struct {
+    settings     *DictObj
+    logs         *appLog
+    stats        *serviceStats
+    dialer       *apnsDialer
+    pool         *connectionPoolWrapper
+    reservedPool *connectionPoolWrapper
+    inFlight     *inFlightSet
+}
+
+// Runtime controls of a single app, for the admin API. Pausing works whether
+// or not the app is running, everything else needs it running.
+type appControl struct {
+    pauseMu sync.Mutex
+    paused  bool
+    // Closed on resume, replaced on pause.
+    resumed chan struct{}
+
+    // Held for as long as the runtime is being used.
+    mu      sync.Mutex
+    runtime *appRuntime
+}
+
+func newAppControl() *appControl {
+    resumed := make(chan struct{})
+    close(resumed)
+    return &appControl{resumed: resumed}
+}
+
+// Stops the app popping anything new. Whatever was popped already carries on.
+func (c *appControl) pause() {
+    c.pauseMu.Lock()
+    defer c.pauseMu.Unlock()
+
+    if !c.paused {
+        c.paused = true
+        c.resumed = make(chan struct{})
+    }
+}
+
+func (c *appControl) resume() {
+    c.pauseMu.Lock()
+    defer c.pauseMu.Unlock()
+
+    if c.paused {
+        c.paused = false
+        close(c.resumed)
+    }
+}
+
+func (c *appControl) isPaused() bool {
+    c.pauseMu.Lock()
+    defer c.pauseMu.Unlock()
+
+    return c.paused
+}
+
+// Runs task unless the app is paused, returning whether it ran. Holds off a
+// pause meanwhile, so a drain sees whatever task put in flight.
+func (c *appControl) unlessPaused(task func()) bool {
+    c.pauseMu.Lock()
+    defer c.pauseMu.Unlock()
+
+    if c.paused {
+        return false
+    }
+    task()
+    return true
+}
+
+// Blocks while the app is paused. Returns false if the context is done first.
+func (c *appControl) waitUntilResumed(ctx context.Context) bool {
+    c.pauseMu.Lock()
+    resumed := c.resumed
+    c.pauseMu.Unlock()
+
+    select {
+    case <-resumed:
+        return true
+    case <-ctx.Done():
+        return false
+    }
+}
+
+// Called by the app once it's up, and again with nil before it shuts down.
+func (c *appControl) attach(runtime *appRuntime) {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+
+    c.runtime = runtime
+}
+
+// Runs task with the runtime, unless the app isn't running.
+func (c *appControl) withRuntime(task func(runtime *appRuntime) error) error {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+
+    if c.runtime == nil {
+        return errors.New("The app isn't running.")
+    }
+    return task(c.runtime)
+}
+
+// Pauses the app and waits up to timeout for the pushes in flight to finish.
+// Returns how many are still going.
+func (c *appControl) drain(timeout time.Duration) (int, error) {
+    c.pause()
+
+    var inFlight *inFlightSet
+    err := c.withRuntime(func(runtime *appRuntime) error {
+        inFlight = runtime.inFlight
+        return nil
+    })
+    if err != nil {
+        return 0, err
+    }
+
+    inFlight.wait(timeout)
+    return inFlight.count(), nil
+}
+
+// Resizes the app's connections to size, the reserved ones included like
+// with 'pool_size'.
+func (c *appControl) resizePool(ctx context.Context, size int) error {
+    return c.withRuntime(func(runtime *appRuntime) error {
+        reserved := 0
+        if runtime.reservedPool != nil {
+            reserved = runtime.reservedPool.connections()
+        }
+        if size-reserved < 1 {
+            return errors.New(fmt.Sprintf("A size of %d leaves none of the connections unreserved, %d are reserved.", size, reserved))
+        }
+
+        err := runtime.pool.resize(ctx, size-reserved, runtime.dialer.dial)
+        if err != nil {
+            return err
+        }
+        runtime.logs.info("Resized the connection pool.", "size", size)
+        return nil
+    })
+}
+
+// Reads the certificates and keys again and swaps every connection for one
+// using them.
+func (c *appControl) reconnect(ctx context.Context) error {
+    return c.withRuntime(func(runtime *appRuntime) error {
+        dialer, err := newApnsDialer(runtime.settings, runtime.logs, runtime.stats)
+        if err != nil {
+            return err
+        }
+
+        for _, pool := range []*connectionPoolWrapper{runtime.pool, runtime.reservedPool} {
+            if pool == nil {
+                continue
+            }
+            err = pool.replaceConns(ctx, dialer.dial)
+            if err != nil {
+                return err
+            }
+        }
+
+        // Connections added later use the new credentials too.
+        runtime.dialer = dialer
+        runtime.logs.info("Reconnected every apns connection.")
+        return nil
+    })
+}
+
+// An app's stats as dumped by the admin API.
+type statsSnapshot struct {
+    Running         bool             `json:"running"`
+    Paused          bool             `json:"paused"`
+    InFlight        int              `json:"in_flight"`
+    Popped          int64            `json:"popped"`
+    Sent            int64            `json:"sent"`
+    Failed          map[uint8]int64  `json:"failed"`
+    Retried         int64            `json:"retried"`
+    DeadLettered    int64            `json:"dead_lettered"`
+    Malformed       int64            `json:"malformed"`
+    Expired         int64            `json:"expired"`
+    Reconnects      int64            `json:"reconnects"`
+    BusyConnections int              `json:"busy_connections"`
+    IdleConnections int              `json:"idle_connections"`
+    QueueDepths     map[string]int64 `json:"queue_depths"`
+}
+
+func (c *appControl) snapshot(stats *serviceStats) statsSnapshot {
+    snapshot := statsSnapshot{
+        Paused:       c.isPaused(),
+        Popped:       atomic.LoadInt64(&stats.popped),
+        Sent:         atomic.LoadInt64(&stats.sent),
+        Retried:      atomic.LoadInt64(&stats.retried),
+        DeadLettered: atomic.LoadInt64(&stats.deadLettered),
+        Malformed:    atomic.LoadInt64(&stats.malformed),
+        Expired:      atomic.LoadInt64(&stats.expired),
+        Reconnects:   atomic.LoadInt64(&stats.reconnects),
+        Failed:       make(map[uint8]int64),
+        QueueDepths:  make(map[string]int64),
+    }
+    snapshot.BusyConnections, snapshot.IdleConnections = stats.poolUsage()
+
+    c.withRuntime(func(runtime *appRuntime) error {
+        snapshot.Running = true
+        snapshot.InFlight = runtime.inFlight.count()
+        return nil
+    })
+
+    stats.mu.Lock()
+    defer stats.mu.Unlock()
+
+    for status, count := range stats.failed {
+        snapshot.Failed[status] = count
+    }
+    for key, depth := range stats.queueDepths {
+        snapshot.QueueDepths[key] = depth
+    }
+    return snapshot
+}
+
+// The admin API, see the README. Every request must carry the token as a
+// bearer token.
+func adminHandler(s *Server, token string) http.Handler {
+    mux := http.NewServeMux()
+
+    // Replies with JSON, errors as {"error": ...}.
+    reply := func(w http.ResponseWriter, code int, body interface{}) {
+        if err, ok := body.(error); ok {
+            body = map[string]string{"error": err.Error()}
+        }
+        w.Header().Set("Content-Type", "application/json")
+        w.WriteHeader(code)
+        json.NewEncoder(w).Encode(body)
+    }
+
+    // The apps a request is about, just the one given by ?app= or all of them.
+    apps := func(r *http.Request) ([]string, error) {
+        names := []string{}
+        if name, ok := r.URL.Query()["app"]; ok {
+            if _, present := s.controls[name[0]]; !present {
+                return nil, errors.New(fmt.Sprintf("Unknown app: %s", name[0]))
+            }
+            return append(names, name[0]), nil
+        }
+
+        for name := range s.controls {
+            names = append(names, name)
+        }
+        sort.Strings(names)
+        return names, nil
+    }
+
+    // The ?timeout= in seconds, or the fallback.
+    timeout := func(r *http.Request, fallback time.Duration) (time.Duration, error) {
+        raw := r.URL.Query().Get("timeout")
+        if raw == "" {
+            return fallback, nil
+        }
+        seconds, err := strconv.ParseFloat(raw, 64)
+        if err != nil || seconds < 0 {
+            return 0, errors.New(fmt.Sprintf("Bad timeout: %s", raw))
+        }
+        return time.Duration(seconds * float64(time.Second)), nil
+    }
+
+    // Registers an endpoint for one method, answering with what task returns
+    // for every app the request is about.
+    handle := func(path, method string, task func(r *http.Request, name string, control *appControl) (interface{}, error)) {
+        mux.HandleFunc(path, func(w http.ResponseWriter, r *http.Request) {
+            if r.Method != method {
+                w.Header().Set("Allow", method)
+                reply(w, http.StatusMethodNotAllowed, errors.New(fmt.Sprintf("Use %s.", method)))
+                return
+            }
+
+            names, err := apps(r)
+            if err != nil {
+                reply(w, http.StatusNotFound, err)
+                return
+            }
+
+            results := make(map[string]interface{})
+            for _, name := range names {
+                result, err := task(r, name, s.controls[name])
+                if err != nil {
+                    if len(names) > 1 {
+                        err = errors.New(fmt.Sprintf("App %s: %s", name, err))
+                    }
+                    reply(w, http.StatusConflict, err)
+                    return
+                }
+                results[name] = result
+            }
+            reply(w, http.StatusOK, map[string]interface{}{"apps": results})
+        })
+    }
+
+    ok := map[string]bool{"ok": true}
+
+    handle("/admin/pause", "POST", func(r *http.Request, name string, control *appControl) (interface{}, error) {
+        control.pause()
+        newAppLog(name).info("Paused through the admin API.")
+        return ok, nil
+    })
+
+    handle("/admin/resume", "POST", func(r *http.Request, name string, control *appControl) (interface{}, error) {
+        control.resume()
+        newAppLog(name).info("Resumed through the admin API.")
+        return ok, nil
+    })
+
+    // Pauses every app first, so they all drain at once.
+    mux.HandleFunc("/admin/drain", func(w http.ResponseWriter, r *http.Request) {
+        if r.Method != "POST" {
+            w.Header().Set("Allow", "POST")
+            reply(w, http.StatusMethodNotAllowed, errors.New("Use POST."))
+            return
+        }
+
+        names, err := apps(r)
+        if err != nil {
+            reply(w, http.StatusNotFound, err)
+            return
+        }
+        for _, name := range names {
+            s.controls[name].pause()
+        }
+
+        results := make(map[string]interface{})
+        for _, name := range names {
+            wait, err := timeout(r, time.Duration(s.apps[name].Float("shutdown_timeout", 30)*float64(time.Second)))
+            if err != nil {
+                reply(w, http.StatusBadRequest, err)
+                return
+            }
+
+            left, err := s.controls[name].drain(wait)
+            if err != nil {
+                reply(w, http.StatusConflict, errors.New(fmt.Sprintf("App %s: %s", name, err)))
+                return
+            }
+            newAppLog(name).info("Drained through the admin API.", "in_flight", left)
+            results[name] = map[string]int{"in_flight": left}
+        }
+        reply(w, http.StatusOK, map[string]interface{}{"apps": results})
+    })
+
+    handle("/admin/pool", "POST", func(r *http.Request, name string, control *appControl) (interface{}, error) {
+        size, err := strconv.Atoi(r.URL.Query().Get("size"))
+        if err != nil {
+            return nil, errors.New("Pass the new pool size as ?size=.")
+        }
+        wait, err := timeout(r, adminTimeout)
+        if err != nil {
+            return nil, err
+        }
+
+        ctx, cancel := context.WithTimeout(r.Context(), wait)
+        defer cancel()
+        return ok, control.resizePool(ctx, size)
+    })
+
+    handle("/admin/reconnect", "POST", func(r *http.Request, name string, control *appControl) (interface{}, error) {
+        wait, err := timeout(r, adminTimeout)
+        if err != nil {
+            return nil, err
+        }
+
+        ctx, cancel := context.WithTimeout(r.Context(), wait)
+        defer cancel()
+        return ok, control.reconnect(ctx)
+    })
+
+    handle("/admin/stats", "GET", func(r *http.Request, name string, control *appControl) (interface{}, error) {
+        return control.snapshot(statsFor(name)), nil
+    })
+
+    handle("/admin/config", "GET", func(r *http.Request, name string, control *appControl) (interface{}, error) {
+        settings := s.apps[name].redacted()
+        delete(settings, "apps")
+        return settings, nil
+    })
+
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        given := []byte(r.Header.Get("Authorization"))
+        if subtle.ConstantTimeCompare(given, []byte("Bearer "+token)) != 1 {
+            w.Header().Set("WWW-Authenticate", "Bearer")
+            reply(w, http.StatusUnauthorized, errors.New("Unauthorized."))
+            return
+        }
+        mux.ServeHTTP(w, r)
+    })
+}
@@ -0,0 +1,201 @@
+package gapless
+
+import (
+    "context"
+    "encoding/json"
+    "github.com/cojac/assert"
+    "net/http"
+    "net/http/httptest"
+    "testing"
+    "time"
+)
+
+// Counts how often it was opened and shut down.
+type fakeTransport struct {
+    warmed int
+    closed int
+}
+
+func (f *fakeTransport) SendPayload(token, payload []byte, expiration time.Time, identity uint32, priority uint8) <-chan error {
+    result := make(chan error, 1)
+    result <- nil
+    return result
+}
+
+func (f *fakeTransport) warmUp() error {
+    f.warmed++
+    return nil
+}
+
+func (f *fakeTransport) shutdown() error {
+    f.closed++
+    return nil
+}
+
+func newFakePool(t *testing.T, size int) (*connectionPoolWrapper, func() (apnsTransport, error), *[]*fakeTransport) {
+    dialed := []*fakeTransport{}
+    dial := func() (apnsTransport, error) {
+        conn := &fakeTransport{}
+        dialed = append(dialed, conn)
+        return conn, nil
+    }
+
+    pool := &connectionPoolWrapper{log: newAppLog("")}
+    err := pool.InitPool(size, dial)
+    assert.Equal(t, nil, err)
+    return pool, dial, &dialed
+}
+
+func TestPoolResize(t *testing.T) {
+    pool, dial, dialed := newFakePool(t, 2)
+    assert.Equal(t, 1, (*dialed)[0].warmed)
+
+    err := pool.resize(context.Background(), 4, dial)
+    assert.Equal(t, nil, err)
+    assert.Equal(t, 4, pool.connections())
+    assert.Equal(t, 4, pool.idle())
+
+    // Shrinking waits for a connection in use to come back.
+    conns := []apnsTransport{pool.GetConn(), pool.GetConn(), pool.GetConn()}
+    ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+    defer cancel()
+    err = pool.resize(ctx, 2, dial)
+    assert.NotEqual(t, nil, err)
+    assert.Equal(t, 3, pool.connections())
+
+    for _, conn := range conns {
+        pool.ReleaseConn(conn)
+    }
+    err = pool.resize(context.Background(), 2, dial)
+    assert.Equal(t, nil, err)
+    assert.Equal(t, 2, pool.idle())
+
+    err = pool.resize(context.Background(), 0, dial)
+    assert.NotEqual(t, nil, err)
+}
+
+func TestPoolReplaceConns(t *testing.T) {
+    pool, dial, dialed := newFakePool(t, 2)
+    old := append([]*fakeTransport{}, *dialed...)
+
+    err := pool.replaceConns(context.Background(), dial)
+    assert.Equal(t, nil, err)
+    assert.Equal(t, 4, len(*dialed))
+    assert.Equal(t, 1, old[0].closed)
+    assert.Equal(t, 1, old[1].closed)
+
+    // A connection never released leaves the pool as it was.
+    held := pool.GetConn()
+    ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+    defer cancel()
+    err = pool.replaceConns(ctx, dial)
+    assert.NotEqual(t, nil, err)
+    assert.Equal(t, 1, pool.idle())
+    assert.Equal(t, 0, held.(*fakeTransport).closed)
+    assert.Equal(t, 1, (*dialed)[4].closed)
+}
+
+func TestPoolUsageWhileDialing(t *testing.T) {
+    pool, dial, _ := newFakePool(t, 2)
+    stats := newServiceStats()
+    stats.setPools(pool)
+
+    // Reconnect on a dial which hangs, say on a handshake.
+    dialing, hung := make(chan bool, 2), make(chan bool)
+    go pool.replaceConns(context.Background(), func() (apnsTransport, error) {
+        dialing <- true
+        <-hung
+        return dial()
+    })
+    <-dialing
+    defer close(hung)
+
+    done := make(chan bool)
+    go func() {
+        busy, idle := stats.poolUsage()
+        assert.Equal(t, 0, busy)
+        assert.Equal(t, 2, idle)
+        done <- true
+    }()
+
+    select {
+    case <-done:
+    case <-time.After(time.Second):
+        t.Fatal("Reporting on the pool waited on the dial.")
+    }
+}
+
+func TestAppControlPause(t *testing.T) {
+    control := newAppControl()
+    assert.Equal(t, true, control.waitUntilResumed(context.Background()))
+
+    control.pause()
+    ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+    defer cancel()
+    assert.Equal(t, false, control.waitUntilResumed(ctx))
+
+    go func() {
+        time.Sleep(10 * time.Millisecond)
+        control.resume()
+    }()
+    assert.Equal(t, true, control.waitUntilResumed(context.Background()))
+}
+
+func TestAppControlUnlessPaused(t *testing.T) {
+    control := newAppControl()
+    ran := 0
+
+    assert.Equal(t, true, control.unlessPaused(func() { ran++ }))
+    control.pause()
+    assert.Equal(t, false, control.unlessPaused(func() { ran++ }))
+    assert.Equal(t, 1, ran)
+}
+
+func TestAdminHandler(t *testing.T) {
+    cfg := NewSettingsObj()
+    cfg.Set("redis_queue_key", "apns_queue")
+    cfg.Set("admin_token", "hunter2")
+    server, err := New(cfg)
+    assert.Equal(t, nil, err)
+    handler := adminHandler(server, "s3cret")
+
+    request := func(method, path, token string) (int, map[string]interface{}) {
+        r := httptest.NewRequest(method, path, nil)
+        if token != "" {
+            r.Header.Set("Authorization", "Bearer "+token)
+        }
+        w := httptest.NewRecorder()
+        handler.ServeHTTP(w, r)
+
+        body := make(map[string]interface{})
+        json.Unmarshal(w.Body.Bytes(), &body)
+        return w.Code, body
+    }
+
+    code, _ := request("GET", "/admin/stats", "")
+    assert.Equal(t, http.StatusUnauthorized, code)
+    code, _ = request("GET", "/admin/stats", "wrong")
+    assert.Equal(t, http.StatusUnauthorized, code)
+
+    code, _ = request("GET", "/admin/pause", "s3cret")
+    assert.Equal(t, http.StatusMethodNotAllowed, code)
+    code, _ = request("POST", "/admin/pause?app=nope", "s3cret")
+    assert.Equal(t, http.StatusNotFound, code)
+
+    code, _ = request("POST", "/admin/pause", "s3cret")
+    assert.Equal(t, http.StatusOK, code)
+    assert.Equal(t, true, server.controls[""].isPaused())
+    code, _ = request("POST", "/admin/resume", "s3cret")
+    assert.Equal(t, http.StatusOK, code)
+    assert.Equal(t, false, server.controls[""].isPaused())
+
+    // The app isn't running, so there's no pool to resize.
+    code, _ = request("POST", "/admin/pool?size=3", "s3cret")
+    assert.Equal(t, http.StatusConflict, code)
+
+    code, body := request("GET", "/admin/config", "s3cret")
+    assert.Equal(t, http.StatusOK, code)
+    config := body["apps"].(map[string]interface{})[""].(map[string]interface{})
+    assert.Equal(t, "apns_queue", config["redis_queue_key"])
+    assert.Equal(t, "[redacted]", config["admin_token"])
+}
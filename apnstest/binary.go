@@ -0,0 +1,145 @@
+package apnstest
+
+import (
+    "bufio"
+    "encoding/binary"
+    "errors"
+    "io"
+    "net"
+)
+
+func (s *Server) accept() {
+    defer s.wg.Done()
+
+    for {
+        conn, err := s.listener.Accept()
+        if err != nil {
+            return
+        }
+
+        s.mu.Lock()
+        s.conns[conn] = true
+        s.mu.Unlock()
+
+        s.wg.Add(1)
+        go s.serveBinary(conn)
+    }
+}
+
+// Reads frames until the client hangs up or a notification is rejected.
+// Like Apple, the server closes the connection after every error response.
+func (s *Server) serveBinary(conn net.Conn) {
+    defer s.wg.Done()
+    defer func() {
+        s.mu.Lock()
+        delete(s.conns, conn)
+        s.mu.Unlock()
+        conn.Close()
+    }()
+
+    r := bufio.NewReader(conn)
+    for {
+        n, err := readFrame(r)
+        if err != nil {
+            return
+        }
+
+        resp := s.respond(n)
+        if resp.Drop {
+            return
+        }
+        if resp.Status != 0 {
+            out := [6]byte{8, resp.Status}
+            binary.BigEndian.PutUint32(out[2:], n.Identifier)
+            conn.Write(out[:])
+            return
+        }
+    }
+}
+
+// Decodes a single command 1 or command 2 notification.
+func readFrame(r io.Reader) (Notification, error) {
+    n := Notification{}
+
+    command := [1]byte{}
+    _, err := io.ReadFull(r, command[:])
+    if err != nil {
+        return n, err
+    }
+
+    switch command[0] {
+    case 1:
+        header := [8]byte{}
+        _, err = io.ReadFull(r, header[:])
+        if err != nil {
+            return n, err
+        }
+        n.Identifier = binary.BigEndian.Uint32(header[:4])
+        n.Expiration = binary.BigEndian.Uint32(header[4:])
+
+        n.Token, err = readItem(r)
+        if err != nil {
+            return n, err
+        }
+        n.Payload, err = readItem(r)
+        return n, err
+
+    case 2:
+        size := [4]byte{}
+        _, err = io.ReadFull(r, size[:])
+        if err != nil {
+            return n, err
+        }
+
+        frame := io.LimitReader(r, int64(binary.BigEndian.Uint32(size[:])))
+        for {
+            id := [1]byte{}
+            _, err = io.ReadFull(frame, id[:])
+            if err == io.EOF {
+                return n, nil
+            }
+            if err != nil {
+                return n, err
+            }
+
+            data, err := readItem(frame)
+            if err != nil {
+                return n, err
+            }
+
+            switch id[0] {
+            case 1:
+                n.Token = data
+            case 2:
+                n.Payload = data
+            case 3:
+                if len(data) == 4 {
+                    n.Identifier = binary.BigEndian.Uint32(data)
+                }
+            case 4:
+                if len(data) == 4 {
+                    n.Expiration = binary.BigEndian.Uint32(data)
+                }
+            case 5:
+                if len(data) == 1 {
+                    n.Priority = data[0]
+                }
+            }
+        }
+    }
+
+    return n, errors.New("apnstest: unsupported command")
+}
+
+// Reads a 2 byte length followed by that many bytes.
+func readItem(r io.Reader) ([]byte, error) {
+    size := [2]byte{}
+    _, err := io.ReadFull(r, size[:])
+    if err != nil {
+        return nil, err
+    }
+
+    data := make([]byte, binary.BigEndian.Uint16(size[:]))
+    _, err = io.ReadFull(r, data)
+    return data, err
+}
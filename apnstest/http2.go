@@ -0,0 +1,136 @@
+package apnstest
+
+import (
+    "crypto/tls"
+    "encoding/hex"
+    "encoding/json"
+    "io"
+    "net"
+    "net/http"
+    "net/http/httptest"
+    "strconv"
+    "strings"
+    "time"
+)
+
+// Reasons (and status codes) matching the binary error statuses.
+var statusReason = map[uint8]string{
+    1:   "InternalServerError",
+    2:   "MissingDeviceToken",
+    3:   "MissingTopic",
+    4:   "PayloadEmpty",
+    5:   "BadDeviceToken",
+    6:   "BadTopic",
+    7:   "PayloadTooLarge",
+    8:   "BadDeviceToken",
+    10:  "Shutdown",
+    255: "InternalServerError",
+}
+
+var reasonStatusCode = map[string]int{
+    "Unregistered":        http.StatusGone,
+    "PayloadTooLarge":     http.StatusRequestEntityTooLarge,
+    "TooManyRequests":     http.StatusTooManyRequests,
+    "InternalServerError": http.StatusInternalServerError,
+    "ServiceUnavailable":  http.StatusServiceUnavailable,
+    "Shutdown":            http.StatusServiceUnavailable,
+    "BadPath":             http.StatusNotFound,
+    "MethodNotAllowed":    http.StatusMethodNotAllowed,
+    "BadCertificate":      http.StatusForbidden,
+    "Forbidden":           http.StatusForbidden,
+}
+
+func (s *Server) startHTTP2(listener net.Listener, tlsCfg *tls.Config) {
+    s.http = httptest.NewUnstartedServer(http.HandlerFunc(s.serveHTTP2))
+    s.http.Listener.Close()
+    s.http.Listener = listener
+    s.http.EnableHTTP2 = true
+    s.http.TLS = tlsCfg
+    s.http.StartTLS()
+
+    s.Addr = listener.Addr().String()
+}
+
+func (s *Server) serveHTTP2(w http.ResponseWriter, r *http.Request) {
+    if r.Method != "POST" {
+        writeReason(w, http.StatusMethodNotAllowed, "MethodNotAllowed")
+        return
+    }
+    if !strings.HasPrefix(r.URL.Path, "/3/device/") {
+        writeReason(w, http.StatusNotFound, "BadPath")
+        return
+    }
+
+    token, err := hex.DecodeString(strings.TrimPrefix(r.URL.Path, "/3/device/"))
+    if err != nil {
+        writeReason(w, http.StatusBadRequest, "BadDeviceToken")
+        return
+    }
+
+    payload, err := io.ReadAll(r.Body)
+    if err != nil {
+        return
+    }
+
+    n := Notification{
+        Token:   token,
+        Payload: payload,
+        ApnsId:  r.Header.Get("apns-id"),
+        Topic:   r.Header.Get("apns-topic"),
+        Bearer:  strings.TrimPrefix(r.Header.Get("authorization"), "bearer "),
+    }
+
+    // Gapless puts its identifier in the last group of the apns-id.
+    if len(n.ApnsId) == 36 {
+        id, err := strconv.ParseUint(n.ApnsId[24:], 16, 32)
+        if err == nil {
+            n.Identifier = uint32(id)
+        }
+    }
+    if expiration, err := strconv.ParseUint(r.Header.Get("apns-expiration"), 10, 32); err == nil {
+        n.Expiration = uint32(expiration)
+    }
+    if priority, err := strconv.ParseUint(r.Header.Get("apns-priority"), 10, 8); err == nil {
+        n.Priority = uint8(priority)
+    }
+
+    resp := s.respond(n)
+    if resp.Drop {
+        // Resets the stream without a response.
+        panic(http.ErrAbortHandler)
+    }
+
+    reason := resp.Reason
+    if reason == "" && resp.Status != 0 {
+        reason = statusReason[resp.Status]
+        if reason == "" {
+            reason = "InternalServerError"
+        }
+    }
+
+    if reason == "" {
+        w.Header().Set("apns-id", n.ApnsId)
+        w.WriteHeader(http.StatusOK)
+        return
+    }
+
+    code := resp.HTTPStatus
+    if code == 0 {
+        code = reasonStatusCode[reason]
+    }
+    if code == 0 {
+        code = http.StatusBadRequest
+    }
+    writeReason(w, code, reason)
+}
+
+func writeReason(w http.ResponseWriter, code int, reason string) {
+    body := map[string]interface{}{"reason": reason}
+    if code == http.StatusGone {
+        body["timestamp"] = time.Now().UnixNano() / int64(time.Millisecond)
+    }
+
+    w.Header().Set("content-type", "application/json")
+    w.WriteHeader(code)
+    json.NewEncoder(w).Encode(body)
+}
@@ -0,0 +1,299 @@
+// Package apnstest provides a mock Apple push server for tests and local development.
+//
+// The server speaks either the binary protocol (command 1 and 2 frames) or the
+// HTTP/2 provider API over TLS, records every notification it receives, and can
+// be scripted to reject, drop or delay individual notifications.
+//
+//    s := apnstest.NewServer()
+//    defer s.Close()
+//
+//    s.Handle(func(n apnstest.Notification) apnstest.Response {
+//        if n.Token[0] == 0xff {
+//            return apnstest.Response{Status: 8}
+//        }
+//        return apnstest.Response{}
+//    })
+//
+// Point gapless at s.Addr, and either trust s.CertPEM() through the
+// apns_pinned_cert_path setting, or use s.ClientTLSConfig() directly.
+package apnstest
+
+import (
+    "crypto/ecdsa"
+    "crypto/elliptic"
+    "crypto/rand"
+    "crypto/tls"
+    "crypto/x509"
+    "crypto/x509/pkix"
+    "encoding/pem"
+    "math/big"
+    "net"
+    "net/http/httptest"
+    "sync"
+    "time"
+)
+
+// Notification is a single push as received by the server.
+type Notification struct {
+    Token      []byte
+    Payload    []byte
+    Identifier uint32
+    Expiration uint32
+    Priority   uint8
+
+    // HTTP/2 only.
+    ApnsId string
+    Topic  string
+    Bearer string
+}
+
+// Response scripts how the server answers a single notification.
+// The zero value accepts it.
+type Response struct {
+    // Binary error status to answer with, for example 8 for Invalid Token.
+    // On the HTTP/2 server it is translated to the matching reason.
+    Status uint8
+    // HTTP/2 reason to answer with, for example "BadDeviceToken".
+    Reason string
+    // HTTP/2 status code sent with Reason, defaults to 400.
+    HTTPStatus int
+    // Close the connection (or reset the stream) without answering.
+    Drop bool
+    // Wait this long before answering.
+    Delay time.Duration
+}
+
+func (r Response) accepted() bool {
+    return r.Status == 0 && r.Reason == "" && !r.Drop
+}
+
+// Server is a running mock push server.
+type Server struct {
+    // Address the server listens on, as host:port.
+    Addr string
+    // Self signed certificate presented by the server.
+    Certificate *x509.Certificate
+
+    listener net.Listener
+    http     *httptest.Server
+    tlsCert  tls.Certificate
+
+    mu       sync.Mutex
+    handler  func(Notification) Response
+    received []Notification
+    rejected []Notification
+    conns    map[net.Conn]bool
+    wg       sync.WaitGroup
+}
+
+// NewServer starts a binary protocol server on a random local port.
+// It panics on failure, like httptest.NewServer.
+func NewServer() *Server {
+    s, err := Listen("127.0.0.1:0", false)
+    if err != nil {
+        panic("apnstest: " + err.Error())
+    }
+    return s
+}
+
+// NewHTTP2Server starts an HTTP/2 provider API server on a random local port.
+// It panics on failure, like httptest.NewServer.
+func NewHTTP2Server() *Server {
+    s, err := Listen("127.0.0.1:0", true)
+    if err != nil {
+        panic("apnstest: " + err.Error())
+    }
+    return s
+}
+
+// Listen starts a server on the given address, which is handy for pointing a
+// locally running gapless at a fixed port.
+func Listen(addr string, useHTTP2 bool) (*Server, error) {
+    s := &Server{conns: make(map[net.Conn]bool)}
+
+    err := s.generateCertificate()
+    if err != nil {
+        return nil, err
+    }
+
+    tlsCfg := &tls.Config{
+        Certificates: []tls.Certificate{s.tlsCert},
+        ClientAuth:   tls.RequestClientCert,
+    }
+
+    listener, err := net.Listen("tcp", addr)
+    if err != nil {
+        return nil, err
+    }
+
+    if useHTTP2 {
+        s.startHTTP2(listener, tlsCfg)
+        return s, nil
+    }
+
+    s.listener = tls.NewListener(listener, tlsCfg)
+    s.Addr = listener.Addr().String()
+
+    s.wg.Add(1)
+    go s.accept()
+
+    return s, nil
+}
+
+// Handle sets the function deciding how each notification is answered.
+// Without one every notification is accepted.
+func (s *Server) Handle(handler func(Notification) Response) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    s.handler = handler
+}
+
+// Notifications returns the notifications accepted so far, in arrival order.
+func (s *Server) Notifications() []Notification {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    return append([]Notification{}, s.received...)
+}
+
+// Rejected returns the notifications which were answered with an error.
+func (s *Server) Rejected() []Notification {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    return append([]Notification{}, s.rejected...)
+}
+
+// Wait blocks until at least n notifications were accepted, or the timeout
+// passes, and returns what was accepted.
+func (s *Server) Wait(n int, timeout time.Duration) []Notification {
+    deadline := time.Now().Add(timeout)
+    for {
+        received := s.Notifications()
+        if len(received) >= n || time.Now().After(deadline) {
+            return received
+        }
+        time.Sleep(5 * time.Millisecond)
+    }
+}
+
+// Reset forgets every notification received so far.
+func (s *Server) Reset() {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    s.received = nil
+    s.rejected = nil
+}
+
+// CertPEM returns the server certificate in PEM form, ready to be written
+// to the file used by the apns_pinned_cert_path or apns_ca_path setting.
+func (s *Server) CertPEM() []byte {
+    return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: s.Certificate.Raw})
+}
+
+// ClientTLSConfig returns a config which trusts the server, and carries a
+// throwaway client certificate since the binary protocol requires one.
+func (s *Server) ClientTLSConfig() *tls.Config {
+    roots := x509.NewCertPool()
+    roots.AddCert(s.Certificate)
+
+    host, _, _ := net.SplitHostPort(s.Addr)
+
+    return &tls.Config{
+        RootCAs:      roots,
+        ServerName:   host,
+        Certificates: []tls.Certificate{s.tlsCert},
+    }
+}
+
+// CloseClientConnections drops every open connection, as Apple does from time to time.
+func (s *Server) CloseClientConnections() {
+    if s.http != nil {
+        s.http.CloseClientConnections()
+        return
+    }
+
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    for conn := range s.conns {
+        conn.Close()
+    }
+}
+
+// Close shuts the server down and waits for its connections to finish.
+func (s *Server) Close() {
+    if s.http != nil {
+        s.http.Close()
+        return
+    }
+
+    s.listener.Close()
+    s.CloseClientConnections()
+    s.wg.Wait()
+}
+
+// Runs the handler and records the outcome.
+func (s *Server) respond(n Notification) Response {
+    s.mu.Lock()
+    handler := s.handler
+    s.mu.Unlock()
+
+    resp := Response{}
+    if handler != nil {
+        resp = handler(n)
+    }
+
+    if resp.Delay > 0 {
+        time.Sleep(resp.Delay)
+    }
+
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    if resp.accepted() {
+        s.received = append(s.received, n)
+    } else if !resp.Drop {
+        s.rejected = append(s.rejected, n)
+    }
+    return resp
+}
+
+func (s *Server) generateCertificate() error {
+    key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+    if err != nil {
+        return err
+    }
+
+    tmpl := &x509.Certificate{
+        SerialNumber:          big.NewInt(time.Now().UnixNano()),
+        Subject:               pkix.Name{CommonName: "apnstest"},
+        NotBefore:             time.Now().Add(-time.Hour),
+        NotAfter:              time.Now().Add(24 * time.Hour),
+        KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+        ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+        BasicConstraintsValid: true,
+        IsCA:                  true,
+        DNSNames:              []string{"localhost"},
+        IPAddresses:           []net.IP{net.ParseIP("127.0.0.1"), net.IPv6loopback},
+    }
+
+    der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+    if err != nil {
+        return err
+    }
+
+    s.Certificate, err = x509.ParseCertificate(der)
+    if err != nil {
+        return err
+    }
+
+    s.tlsCert = tls.Certificate{
+        Certificate: [][]byte{der},
+        PrivateKey:  key,
+        Leaf:        s.Certificate,
+    }
+    return nil
+}
@@ -0,0 +1,60 @@
+package apnstest
+
+import (
+    "bytes"
+    "crypto/tls"
+    "encoding/binary"
+    "testing"
+    "time"
+)
+
+func commandOne(id uint32, token, payload []byte) []byte {
+    buf := bytes.NewBuffer([]byte{1})
+    binary.Write(buf, binary.BigEndian, id)
+    binary.Write(buf, binary.BigEndian, uint32(0))
+    binary.Write(buf, binary.BigEndian, uint16(len(token)))
+    buf.Write(token)
+    binary.Write(buf, binary.BigEndian, uint16(len(payload)))
+    buf.Write(payload)
+    return buf.Bytes()
+}
+
+func TestReadFrameCommandOne(t *testing.T) {
+    n, err := readFrame(bytes.NewReader(commandOne(9, []byte{1, 2}, []byte("{}"))))
+    if err != nil {
+        t.Fatalf("Unexpected error: %s", err)
+    }
+    if n.Identifier != 9 || !bytes.Equal(n.Token, []byte{1, 2}) || string(n.Payload) != "{}" {
+        t.Errorf("Decoded the wrong notification: %+v", n)
+    }
+}
+
+func TestServerRejects(t *testing.T) {
+    s := NewServer()
+    defer s.Close()
+
+    s.Handle(func(n Notification) Response {
+        return Response{Status: 8}
+    })
+
+    conn, err := tls.Dial("tcp", s.Addr, s.ClientTLSConfig())
+    if err != nil {
+        t.Fatalf("Dial failed: %s", err)
+    }
+    defer conn.Close()
+
+    conn.Write(commandOne(5, []byte{1}, []byte("{}")))
+
+    conn.SetReadDeadline(time.Now().Add(time.Second))
+    out := make([]byte, 6)
+    _, err = conn.Read(out)
+    if err != nil {
+        t.Fatalf("Read failed: %s", err)
+    }
+    if !bytes.Equal(out, []byte{8, 8, 0, 0, 0, 5}) {
+        t.Errorf("Unexpected error response: %v", out)
+    }
+    if len(s.Rejected()) != 1 || len(s.Notifications()) != 0 {
+        t.Errorf("Rejection was not recorded")
+    }
+}
@@ -0,0 +1,160 @@
+package gapless
+
+import (
+    "context"
+    "errors"
+    "fmt"
+    "sync"
+    "sync/atomic"
+    "time"
+)
+
+// Notification is a single push for Client to send.
+type Notification struct {
+    // The raw device token, hex.DecodeString it if you have it as a string.
+    Token []byte
+    // The json payload, the "aps" dict and any custom keys.
+    Payload    []byte
+    Identifier uint32
+    // When Apple may stop trying to deliver it. The zero time means try once.
+    Expiration time.Time
+    // 10 or 5, 0 leaves it to Apple.
+    Priority uint8
+}
+
+// Outcome says what became of a notification.
+type Outcome int
+
+const (
+    // Sent means Apple accepted the notification.
+    Sent Outcome = iota
+    // Rejected means Apple refused it, Result.Err is the *APNsError saying why.
+    Rejected
+    // Expired means it had expired before we got to send it, so it wasn't.
+    Expired
+    // Failed means we couldn't get an answer out of Apple at all, Result.Err
+    // holds what went wrong. It may or may not have been delivered.
+    Failed
+)
+
+func (o Outcome) String() string {
+    switch o {
+    case Sent:
+        return "Sent"
+    case Rejected:
+        return "Rejected"
+    case Expired:
+        return "Expired"
+    }
+    return "Failed"
+}
+
+// Result is what became of a single notification.
+type Result struct {
+    Identifier uint32
+    Outcome    Outcome
+    Err        error
+}
+
+// Client sends notifications straight from Go code, over a pool of
+// connections set up just like the redis pipeline's.
+type Client struct {
+    pool *connectionPoolWrapper
+    // Set once Close has been called, only touched through sync/atomic.
+    closed int32
+}
+
+// NewClient connects a pool of connections to Apple using the APNS and
+// 'pool_size' settings. Close it once done.
+func NewClient(cfg *DictObj) (*Client, error) {
+    logs := newAppLog("")
+
+    dialer, err := newApnsDialer(cfg, logs, newServiceStats())
+    if err != nil {
+        return nil, err
+    }
+
+    pool := &connectionPoolWrapper{log: logs}
+    err = pool.InitPool(cfg.Int("pool_size", 2), dialer.dial)
+    if err != nil {
+        return nil, errors.New(fmt.Sprintf("Connection pool failed to initialize: %s.", err))
+    }
+    return &Client{pool: pool}, nil
+}
+
+// Send delivers a notification, waiting for Apple's verdict. The error is only
+// set (to the same thing as Result.Err) when the outcome is Failed, which
+// includes the context being done before Apple answered.
+func (c *Client) Send(ctx context.Context, n Notification) (Result, error) {
+    result := Result{Identifier: n.Identifier}
+
+    if atomic.LoadInt32(&c.closed) != 0 {
+        result.Outcome, result.Err = Failed, errors.New("Client is closed")
+        return result, result.Err
+    }
+
+    if !n.Expiration.IsZero() && n.Expiration.Before(time.Now()) {
+        result.Outcome = Expired
+        return result, nil
+    }
+
+    conn, err := c.pool.GetConnContext(ctx)
+    if err != nil {
+        result.Outcome, result.Err = Failed, err
+        return result, err
+    }
+
+    // The connection goes back as soon as the notification is written.
+    sent := conn.SendPayload(n.Token, n.Payload, n.Expiration, n.Identifier, n.Priority)
+    c.pool.ReleaseConn(conn)
+
+    select {
+    case err = <-sent:
+    case <-ctx.Done():
+        err = ctx.Err()
+    }
+
+    if apnsErr, ok := err.(*APNsError); ok {
+        result.Outcome, result.Err = Rejected, apnsErr
+        return result, nil
+    }
+    if err != nil {
+        result.Outcome, result.Err = Failed, err
+        return result, err
+    }
+    result.Outcome = Sent
+    return result, nil
+}
+
+// SendMany delivers a batch of notifications all at once, sharing the pool's
+// connections. Results come back in the same order as the notifications, the
+// error is the first Failed one's, if any.
+func (c *Client) SendMany(ctx context.Context, notifications []Notification) ([]Result, error) {
+    results := make([]Result, len(notifications))
+
+    var wg sync.WaitGroup
+    for x, n := range notifications {
+        wg.Add(1)
+        go func(x int, n Notification) {
+            defer wg.Done()
+            results[x], _ = c.Send(ctx, n)
+        }(x, n)
+    }
+    wg.Wait()
+
+    for _, result := range results {
+        if result.Outcome == Failed {
+            return results, result.Err
+        }
+    }
+    return results, nil
+}
+
+// Close waits for every connection to be free, then shuts them all down.
+// Sends after that fail, closing again does nothing.
+func (c *Client) Close() {
+    if !atomic.CompareAndSwapInt32(&c.closed, 0, 1) {
+        return
+    }
+    c.pool.ShutdownConns()
+}
@@ -0,0 +1,107 @@
+package gapless
+
+import (
+    "context"
+    "github.com/cojac/assert"
+    "github.com/cojac/gapless/apnstest"
+    "testing"
+    "time"
+)
+
+func newTestClient(t *testing.T, s *apnstest.Server) *Client {
+    pool := &connectionPoolWrapper{log: newAppLog("")}
+    err := pool.InitPool(2, func() (apnsTransport, error) {
+        return newApnsHttp2Client(s.Addr, s.ClientTLSConfig(), "com.example.app", nil)
+    })
+    assert.Equal(t, nil, err)
+    return &Client{pool: pool}
+}
+
+func TestClientSend(t *testing.T) {
+    s := apnstest.NewHTTP2Server()
+    defer s.Close()
+
+    client := newTestClient(t, s)
+    defer client.Close()
+
+    result, err := client.Send(context.Background(), Notification{Token: []byte{0xab}, Payload: []byte(`{"aps":{}}`), Identifier: 3})
+    assert.Equal(t, nil, err)
+    assert.Equal(t, Sent, result.Outcome)
+    assert.Equal(t, uint32(3), result.Identifier)
+    assert.Equal(t, 1, len(s.Notifications()))
+
+    // Already expired, so never sent.
+    result, err = client.Send(context.Background(), Notification{Token: []byte{0xab}, Payload: []byte("{}"), Expiration: time.Now().Add(-time.Minute)})
+    assert.Equal(t, nil, err)
+    assert.Equal(t, Expired, result.Outcome)
+    assert.Equal(t, 1, len(s.Notifications()))
+}
+
+func TestClientSendMany(t *testing.T) {
+    s := apnstest.NewHTTP2Server()
+    defer s.Close()
+
+    s.Handle(func(n apnstest.Notification) apnstest.Response {
+        if n.Identifier == 2 {
+            return apnstest.Response{Reason: "BadDeviceToken"}
+        }
+        return apnstest.Response{}
+    })
+
+    client := newTestClient(t, s)
+    defer client.Close()
+
+    notifications := []Notification{}
+    for x := uint32(1); x <= 3; x++ {
+        notifications = append(notifications, Notification{Token: []byte{0xab}, Payload: []byte("{}"), Identifier: x})
+    }
+
+    results, err := client.SendMany(context.Background(), notifications)
+    assert.Equal(t, nil, err)
+    assert.Equal(t, 3, len(results))
+    assert.Equal(t, Sent, results[0].Outcome)
+    assert.Equal(t, Rejected, results[1].Outcome)
+    assert.Equal(t, newHttp2Error(400, "BadDeviceToken", 2), results[1].Err)
+    assert.Equal(t, Sent, results[2].Outcome)
+}
+
+func TestClientSendCancelled(t *testing.T) {
+    s := apnstest.NewHTTP2Server()
+    defer s.Close()
+
+    client := newTestClient(t, s)
+    defer client.Close()
+
+    ctx, cancel := context.WithCancel(context.Background())
+    cancel()
+
+    // Every connection busy, so the send can only give up.
+    held := []apnsTransport{client.pool.GetConn(), client.pool.GetConn()}
+    result, err := client.Send(ctx, Notification{Token: []byte{0xab}, Payload: []byte("{}")})
+    assert.Equal(t, context.Canceled, err)
+    assert.Equal(t, Failed, result.Outcome)
+
+    for _, conn := range held {
+        client.pool.ReleaseConn(conn)
+    }
+}
+
+func TestClientSendAfterClose(t *testing.T) {
+    s := apnstest.NewHTTP2Server()
+    defer s.Close()
+
+    client := newTestClient(t, s)
+    client.Close()
+    client.Close()
+
+    result, err := client.Send(context.Background(), Notification{Token: []byte{0xab}, Payload: []byte(`{"aps":{}}`)})
+    assert.NotEqual(t, nil, err)
+    assert.Equal(t, Failed, result.Outcome)
+    assert.Equal(t, "Client is closed", err.Error())
+    assert.Equal(t, 0, len(s.Notifications()))
+
+    // One which got past that check before Close gets an error too, not a
+    // nil connection.
+    _, err = client.pool.GetConnContext(context.Background())
+    assert.NotEqual(t, nil, err)
+}
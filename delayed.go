@@ -0,0 +1,195 @@
+package gapless
+
+import (
+    "context"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "io"
+    "strconv"
+    "sync"
+    "time"
+)
+
+// How often due items are looked for.
+const delayedPollInterval = 500 * time.Millisecond
+
+// How many due items are moved at a time.
+const delayedBatch = 100
+
+// Moves up to ARGV[2] items due by ARGV[1] from the sorted set KEYS[1] to the
+// front of the list KEYS[2], returning them. In one go, so an item is never
+// off the set without being on the list.
+const promoteScript = `
+local due = redis.call('ZRANGEBYSCORE', KEYS[1], '-inf', ARGV[1], 'LIMIT', 0, ARGV[2])
+for _, raw in ipairs(due) do
+    redis.call('ZREM', KEYS[1], raw)
+    redis.call('LPUSH', KEYS[2], raw)
+end
+return due
+`
+
+// A redis sorted set of notifications waiting for their time to come, scored
+// by the unix time (in milliseconds) they are due. Used for retries and for
+// notifications scheduled with send_at.
+//
+// When indexed, a set per identifier (<key>:id:<identifier>) tracks which
+// members belong to it, so they can be cancelled.
+type delayedSet struct {
+    client  redisClient
+    key     string
+    indexed bool
+    mu      sync.Mutex
+    log     *appLog
+}
+
+func (d *delayedSet) indexKey(identifier uint32) string {
+    return d.key + ":id:" + strconv.FormatUint(uint64(identifier), 10)
+}
+
+func (d *delayedSet) add(raw string, at time.Time, identifier uint32) error {
+    d.mu.Lock()
+    defer d.mu.Unlock()
+
+    _, err := d.client.ZAdd(d.key, at.UnixNano()/int64(time.Millisecond), raw)
+    if err != nil || !d.indexed {
+        return err
+    }
+
+    _, err = d.client.SAdd(d.indexKey(identifier), raw)
+    return err
+}
+
+// Drops every waiting item with the given identifier, returning how many.
+func (d *delayedSet) cancel(identifier uint32) (int, error) {
+    d.mu.Lock()
+    defer d.mu.Unlock()
+
+    members, err := d.client.SMembers(d.indexKey(identifier))
+    if err != nil {
+        return 0, err
+    }
+
+    cancelled := 0
+    for _, raw := range members {
+        removed, err := d.client.ZRem(d.key, raw)
+        if err != nil {
+            return cancelled, err
+        }
+        cancelled += int(removed)
+    }
+
+    _, err = d.client.Del(d.indexKey(identifier))
+    return cancelled, err
+}
+
+// Moves due items to the front of the queue until the context is cancelled.
+// Several instances may share the set, the script moving each item only once.
+func (d *delayedSet) promote(ctx context.Context, queue *redisQueue) {
+    for {
+        err := d.promoteDue(queue)
+        if err != nil {
+            d.log.error("Promoting due items failed.", "key", d.key, "error", err)
+        }
+
+        select {
+        case <-ctx.Done():
+            return
+        case <-time.After(delayedPollInterval):
+        }
+    }
+}
+
+func (d *delayedSet) promoteDue(queue *redisQueue) error {
+    d.mu.Lock()
+    defer d.mu.Unlock()
+
+    now := strconv.FormatInt(time.Now().UnixNano()/int64(time.Millisecond), 10)
+    due := []string{}
+    err := d.client.Command(&due, "EVAL", promoteScript, 2, d.key, queue.key, now, delayedBatch)
+    if err != nil || !d.indexed {
+        return err
+    }
+
+    // Only used for cancelling, so a member left behind here does no harm.
+    for _, raw := range due {
+        d.client.SRem(d.indexKey(identifierOf(raw)), raw)
+    }
+    return nil
+}
+
+// Pulls the identifier out of a raw queue item, 0 when there isn't one.
+func identifierOf(raw string) uint32 {
+    jsonIn := struct {
+        Identifier uint32 `json:"identifier"`
+    }{}
+    json.Unmarshal([]byte(raw), &jsonIn)
+    return jsonIn.Identifier
+}
+
+// ScheduleCommand inspects or manages notifications waiting on their send_at.
+// Supported commands:
+//
+//    count               prints how many items are waiting
+//    cancel <identifier> drops every waiting item with that identifier
+//
+// Results go to out.
+func ScheduleCommand(settings *DictObj, args []string, out io.Writer) error {
+    queueKeyList, _, err := queueKeys(settings)
+    if err != nil {
+        return err
+    }
+    if len(args) == 0 {
+        return errors.New("Expected one of: count, cancel.")
+    }
+
+    // Every queue has a scheduled set of its own.
+    client, err := newRedisConn(settings)
+    if err != nil {
+        return err
+    }
+    defer client.Quit()
+
+    sets := []*delayedSet{}
+    for _, queueKey := range queueKeyList {
+        _, scheduleKey := delayedKeys(settings, queueKey, len(queueKeyList) == 1)
+        sets = append(sets, &delayedSet{client: client, key: scheduleKey, indexed: true})
+    }
+
+    switch args[0] {
+    case "count":
+        total := int64(0)
+        for _, scheduled := range sets {
+            count, err := client.ZCard(scheduled.key)
+            if err != nil {
+                return err
+            }
+            total += count
+        }
+        fmt.Fprintln(out, total)
+
+    case "cancel":
+        if len(args) < 2 {
+            return errors.New("Expected an identifier to cancel.")
+        }
+        identifier, err := strconv.ParseUint(args[1], 10, 32)
+        if err != nil {
+            return errors.New(fmt.Sprintf("Invalid identifier: %s", args[1]))
+        }
+
+        total := 0
+        for _, scheduled := range sets {
+            cancelled, err := scheduled.cancel(uint32(identifier))
+            if err != nil {
+                return err
+            }
+            total += cancelled
+        }
+        fmt.Fprintf(out, "Cancelled %d items.\n", total)
+
+    default:
+        return errors.New(fmt.Sprintf("Unknown command %q, expected one of: count, cancel.", args[0]))
+    }
+
+    return nil
+}
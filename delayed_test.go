@@ -0,0 +1,111 @@
+package gapless
+
+import (
+    "github.com/cojac/assert"
+    "testing"
+    "time"
+)
+
+func testDelayedSet(client *fakeRedis, indexed bool) *delayedSet {
+    return &delayedSet{client: client, key: "apns_queue:scheduled", indexed: indexed, log: newAppLog("test")}
+}
+
+func TestDelayedPromoteDue(t *testing.T) {
+    client := newFakeRedis()
+    queue := testQueue(client, false, "one")
+    scheduled := testDelayedSet(client, true)
+    client.RPush(queue.key, "queued")
+
+    now := time.Now()
+    scheduled.add(`{"identifier":1,"n":"first"}`, now.Add(-2*time.Second), 1)
+    scheduled.add(`{"identifier":2,"n":"second"}`, now.Add(-time.Second), 2)
+    scheduled.add(`{"identifier":3,"n":"later"}`, now.Add(time.Hour), 3)
+
+    assert.Equal(t, nil, scheduled.promoteDue(queue))
+
+    // Due items go in front of what was queued, only the later one waits on.
+    assert.Equal(t, []string{`{"identifier":2,"n":"second"}`, `{"identifier":1,"n":"first"}`, "queued"}, client.list(queue.key))
+    assert.Equal(t, []string{`{"identifier":3,"n":"later"}`}, client.zset(scheduled.key))
+
+    // And are no longer there to be cancelled.
+    members, _ := client.SMembers(scheduled.indexKey(1))
+    assert.Equal(t, []string{}, members)
+    members, _ = client.SMembers(scheduled.indexKey(3))
+    assert.Equal(t, 1, len(members))
+}
+
+func TestDelayedPromoteDueBatch(t *testing.T) {
+    client := newFakeRedis()
+    queue := testQueue(client, false, "one")
+    retries := testDelayedSet(client, false)
+
+    past := time.Now().Add(-time.Second)
+    for x := 0; x < delayedBatch+5; x++ {
+        retries.add(string(rune('a'+x%26))+string(rune('a'+x/26)), past, 0)
+    }
+
+    assert.Equal(t, nil, retries.promoteDue(queue))
+    assert.Equal(t, delayedBatch, len(client.list(queue.key)))
+    assert.Equal(t, 5, len(client.zset(retries.key)))
+
+    assert.Equal(t, nil, retries.promoteDue(queue))
+    assert.Equal(t, delayedBatch+5, len(client.list(queue.key)))
+    assert.Equal(t, 0, len(client.zset(retries.key)))
+}
+
+func TestDelayedCancel(t *testing.T) {
+    client := newFakeRedis()
+    scheduled := testDelayedSet(client, true)
+
+    later := time.Now().Add(time.Hour)
+    scheduled.add(`{"identifier":7,"n":1}`, later, 7)
+    scheduled.add(`{"identifier":7,"n":2}`, later, 7)
+    scheduled.add(`{"identifier":8}`, later, 8)
+
+    cancelled, err := scheduled.cancel(7)
+    assert.Equal(t, nil, err)
+    assert.Equal(t, 2, cancelled)
+    assert.Equal(t, []string{`{"identifier":8}`}, client.zset(scheduled.key))
+
+    exists, _ := client.Exists(scheduled.indexKey(7))
+    assert.Equal(t, false, exists)
+
+    cancelled, err = scheduled.cancel(7)
+    assert.Equal(t, nil, err)
+    assert.Equal(t, 0, cancelled)
+}
+
+// Items without an identifier share the index of identifier 0, so they can
+// all be cancelled in one go, and promoting one leaves the others be.
+func TestDelayedCancelUnidentified(t *testing.T) {
+    client := newFakeRedis()
+    queue := testQueue(client, false, "one")
+    scheduled := testDelayedSet(client, true)
+
+    now := time.Now()
+    scheduled.add(`{"n":"due"}`, now.Add(-time.Second), identifierOf(`{"n":"due"}`))
+    scheduled.add(`{"n":"later"}`, now.Add(time.Hour), identifierOf(`{"n":"later"}`))
+    scheduled.add(`{"identifier":0,"n":"zero"}`, now.Add(time.Hour), 0)
+
+    assert.Equal(t, nil, scheduled.promoteDue(queue))
+    assert.Equal(t, []string{`{"n":"due"}`}, client.list(queue.key))
+
+    members, _ := client.SMembers(scheduled.indexKey(0))
+    assert.Equal(t, 2, len(members))
+
+    cancelled, err := scheduled.cancel(0)
+    assert.Equal(t, nil, err)
+    assert.Equal(t, 2, cancelled)
+    assert.Equal(t, []string{}, client.zset(scheduled.key))
+    assert.Equal(t, []string{`{"n":"due"}`}, client.list(queue.key))
+}
+
+func TestDelayedRetriesNotIndexed(t *testing.T) {
+    client := newFakeRedis()
+    retries := testDelayedSet(client, false)
+
+    retries.add(`{"identifier":4}`, time.Now().Add(time.Hour), 4)
+    exists, _ := client.Exists(retries.indexKey(4))
+    assert.Equal(t, false, exists)
+    assert.Equal(t, 1, len(client.zset(retries.key)))
+}
@@ -0,0 +1,208 @@
+package gapless
+
+import (
+    "encoding/json"
+    "errors"
+    "fmt"
+    "io"
+    "strconv"
+    "sync"
+)
+
+// Envelope for a notification gapless gave up on.
+type deadLetter struct {
+    // The raw queue item, exactly as it was popped.
+    Payload string `json:"payload"`
+    // The queue it was popped from.
+    Queue   string `json:"queue,omitempty"`
+    Error   string `json:"error"`
+    // How many times we tried to send it, 0 when it never got that far.
+    Attempts      int   `json:"attempts"`
+    FirstFailedAt int64 `json:"first_failed_at,omitempty"`
+    FailedAt      int64 `json:"failed_at"`
+}
+
+// A redis list collecting notifications which failed for good.
+type deadLetterQueue struct {
+    client redisClient
+    key    string
+    mu     sync.Mutex
+}
+
+func (d *deadLetterQueue) push(letter deadLetter) error {
+    raw, err := json.Marshal(letter)
+    if err != nil {
+        return err
+    }
+
+    d.mu.Lock()
+    defer d.mu.Unlock()
+
+    _, err = d.client.RPush(d.key, string(raw))
+    return err
+}
+
+// Strips our bookkeeping from a queue item, so a replayed item gets a fresh
+// set of retries. Items which aren't json are left alone.
+func resetPayload(payload string) string {
+    jsonIn := make(map[string]interface{})
+    err := json.Unmarshal([]byte(payload), &jsonIn)
+    if err != nil {
+        return payload
+    }
+
+    delete(jsonIn, "_gapless_RETRYING")
+    delete(jsonIn, "_gapless_FIRST_FAILED")
+    delete(jsonIn, "_gapless_RETRY_AT")
+
+    out, err := json.Marshal(jsonIn)
+    if err != nil {
+        return payload
+    }
+    return string(out)
+}
+
+// DeadLetterCommand inspects or manages the dead letter queue named by the
+// 'dead_letter_key' setting. Supported commands:
+//
+//    count           prints how many items are waiting
+//    list [n]        prints the first n items (all by default)
+//    replay [n]      moves the first n items (all by default) back onto the queue
+//    purge           deletes every item
+//
+// Results go to out, payloads redacted as 'log_redact' says.
+func DeadLetterCommand(settings *DictObj, args []string, out io.Writer) error {
+    key := settings.String("dead_letter_key", "")
+    if key == "" {
+        return errors.New("The 'dead_letter_key' must be defined in your settings.")
+    }
+    if len(args) == 0 {
+        return errors.New("Expected one of: count, list, replay, purge.")
+    }
+    redactor, err := newRedactor(settings)
+    if err != nil {
+        return err
+    }
+
+    limit := int64(-1)
+    if len(args) > 1 {
+        n, err := strconv.ParseInt(args[1], 10, 64)
+        if err != nil || n < 1 {
+            return errors.New(fmt.Sprintf("Invalid count: %s", args[1]))
+        }
+        limit = n
+    }
+
+    client, err := newRedisConn(settings)
+    if err != nil {
+        return err
+    }
+    defer client.Quit()
+
+    switch args[0] {
+    case "count":
+        count, err := client.LLen(key)
+        if err != nil {
+            return err
+        }
+        fmt.Fprintln(out, count)
+
+    case "list":
+        stop := int64(-1)
+        if limit > 0 {
+            stop = limit - 1
+        }
+
+        items, err := client.LRange(key, 0, stop)
+        if err != nil {
+            return err
+        }
+        for _, item := range items {
+            fmt.Fprintln(out, redactDeadLetter(redactor, item))
+        }
+
+    case "replay":
+        return replayDeadLetters(settings, client, key, limit, redactor, out)
+
+    case "purge":
+        _, err := client.Del(key)
+        if err != nil {
+            return err
+        }
+
+    default:
+        return errors.New(fmt.Sprintf("Unknown command %q, expected one of: count, list, replay, purge.", args[0]))
+    }
+
+    return nil
+}
+
+// Moves dead letters back onto the queue they came from (the first queue, for
+// letters which don't say), at the producer's end of the line.
+func replayDeadLetters(settings *DictObj, client redisClient, key string, limit int64, redactor *appLog, out io.Writer) error {
+    queueKeyList, _, err := queueKeys(settings)
+    if err != nil {
+        return err
+    }
+
+    count, err := client.LLen(key)
+    if err != nil {
+        return err
+    }
+    if limit > 0 && limit < count {
+        count = limit
+    }
+
+    replayed := 0
+    for x := int64(0); x < count; x++ {
+        raw, err := client.LPop(key)
+        if isNilReply(err) {
+            // Emptied by someone else in the meantime.
+            break
+        }
+        if err != nil {
+            return err
+        }
+
+        letter := deadLetter{}
+        err = json.Unmarshal([]byte(raw), &letter)
+        if err != nil {
+            // Not one of ours, put it back at the end and move on.
+            client.RPush(key, raw)
+            fmt.Fprintf(out, "Skipping unreadable dead letter: %s\n", redactDeadLetter(redactor, raw))
+            continue
+        }
+
+        queueKey := letter.Queue
+        if queueKey == "" {
+            queueKey = queueKeyList[0]
+        }
+
+        _, err = client.RPush(queueKey, resetPayload(letter.Payload))
+        if err != nil {
+            client.LPush(key, raw)
+            return err
+        }
+        replayed++
+    }
+
+    fmt.Fprintf(out, "Replayed %d items.\n", replayed)
+    return nil
+}
+
+// A dead letter as it should be printed, its payload redacted like it would be
+// in the logs. Anything which isn't a dead letter goes through as a payload.
+func redactDeadLetter(redactor *appLog, raw string) string {
+    letter := deadLetter{}
+    err := json.Unmarshal([]byte(raw), &letter)
+    if err != nil {
+        return redactor.payload(raw).LogValue().String()
+    }
+
+    letter.Payload = redactor.payload(letter.Payload).LogValue().String()
+    out, err := json.Marshal(letter)
+    if err != nil {
+        return "[omitted]"
+    }
+    return string(out)
+}
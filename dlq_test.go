@@ -0,0 +1,87 @@
+package gapless
+
+import (
+    "bytes"
+    "github.com/cojac/assert"
+    "strings"
+    "testing"
+)
+
+func TestResetPayload(t *testing.T) {
+    in := `{"_gapless_FIRST_FAILED":1400000000,"_gapless_RETRYING":3,"data":{"aps":{}},"token":"abcd"}`
+    assert.Equal(t, `{"data":{"aps":{}},"token":"abcd"}`, resetPayload(in))
+
+    // Not json, nothing to strip.
+    assert.Equal(t, `"token": "abcd"}`, resetPayload(`"token": "abcd"}`))
+}
+
+func TestDeadLetterPush(t *testing.T) {
+    client := newFakeRedis()
+    deadLetters := &deadLetterQueue{client: client, key: "dead"}
+
+    letter := deadLetter{Payload: `{"token":"abcd"}`, Queue: "apns_queue", Error: "Invalid Token", Attempts: 1, FailedAt: 1400000000}
+    assert.Equal(t, nil, deadLetters.push(letter))
+
+    assert.Equal(t, []string{`{"payload":"{\"token\":\"abcd\"}","queue":"apns_queue","error":"Invalid Token","attempts":1,"failed_at":1400000000}`}, client.list("dead"))
+}
+
+func TestDeadLetterReplay(t *testing.T) {
+    client := newFakeRedis()
+    deadLetters := &deadLetterQueue{client: client, key: "dead"}
+    client.RPush("apns_queue", "queued")
+
+    deadLetters.push(deadLetter{Payload: `{"_gapless_RETRYING":3,"token":"aa"}`, Queue: "apns_queue"})
+    deadLetters.push(deadLetter{Payload: `{"token":"bb"}`, Queue: "apns_high"})
+    client.RPush("dead", "not a letter")
+    deadLetters.push(deadLetter{Payload: `{"token":"cc"}`})
+
+    settings := NewSettingsObj()
+    settings.Set("redis_queue_key", "apns_queue")
+    settings.Set("log_redact", "hash")
+    redactor, err := newRedactor(settings)
+    assert.Equal(t, nil, err)
+
+    // Replayed at the producer's end of their own queue (the first one when
+    // they don't say) with their retries reset, anything unreadable stays.
+    out := &bytes.Buffer{}
+    assert.Equal(t, nil, replayDeadLetters(settings, client, "dead", -1, redactor, out))
+    assert.Equal(t, []string{"queued", `{"token":"aa"}`, `{"token":"cc"}`}, client.list("apns_queue"))
+    assert.Equal(t, []string{`{"token":"bb"}`}, client.list("apns_high"))
+    assert.Equal(t, []string{"not a letter"}, client.list("dead"))
+
+    // What's unreadable isn't printed as it is.
+    assert.Equal(t, "Skipping unreadable dead letter: [omitted]\nReplayed 3 items.\n", out.String())
+}
+
+func TestRedactDeadLetter(t *testing.T) {
+    settings := NewSettingsObj()
+    settings.Set("log_redact", "truncate")
+    redactor, err := newRedactor(settings)
+    assert.Equal(t, nil, err)
+
+    raw := `{"payload":"{\"data\":{\"aps\":{\"alert\":\"secret\"}},\"token\":\"71c12814d8f7\"}","error":"Invalid Token","attempts":1,"failed_at":1400000000}`
+    redacted := redactDeadLetter(redactor, raw)
+    assert.Equal(t, false, strings.Contains(redacted, "secret"))
+    assert.Equal(t, false, strings.Contains(redacted, "71c12814d8f7"))
+    assert.Equal(t, true, strings.Contains(redacted, `71c12814...`))
+    assert.Equal(t, true, strings.Contains(redacted, `"error":"Invalid Token"`))
+
+    settings.Set("log_redact", "bogus")
+    _, err = newRedactor(settings)
+    assert.NotEqual(t, nil, err)
+}
+
+func TestDeadLetterReplayLimit(t *testing.T) {
+    client := newFakeRedis()
+    deadLetters := &deadLetterQueue{client: client, key: "dead"}
+    for _, token := range []string{"aa", "bb", "cc"} {
+        deadLetters.push(deadLetter{Payload: `{"token":"` + token + `"}`, Queue: "apns_queue"})
+    }
+
+    settings := NewSettingsObj()
+    settings.Set("redis_queue_key", "apns_queue")
+
+    assert.Equal(t, nil, replayDeadLetters(settings, client, "dead", 2, newAppLog(""), &bytes.Buffer{}))
+    assert.Equal(t, []string{`{"token":"aa"}`, `{"token":"bb"}`}, client.list("apns_queue"))
+    assert.Equal(t, 1, len(client.list("dead")))
+}
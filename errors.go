@@ -0,0 +1,115 @@
+package gapless
+
+import (
+    "fmt"
+    "net/http"
+)
+
+// APNsError is the error returned when Apple rejects a notification.
+type APNsError struct {
+    // Status code from the binary protocol, for example 8 for Invalid Token.
+    // HTTP/2 reasons are mapped onto the closest code, or 255 when none fits.
+    Status uint8
+    // Identifier of the rejected notification, as given in the queue json.
+    Identifier uint32
+    // Human readable description for the binary protocol, or the reason
+    // string Apple sent back (for example "BadDeviceToken") for HTTP/2.
+    Reason string
+    // Status code of the HTTP/2 response, 0 for the binary protocol.
+    HTTPStatus int
+}
+
+func (e *APNsError) Error() string {
+    return e.Reason
+}
+
+// Temporary reports whether sending the same notification again may work,
+// because the problem was on Apple's side rather than with the notification.
+func (e *APNsError) Temporary() bool {
+    if e.HTTPStatus != 0 {
+        switch e.HTTPStatus {
+        case http.StatusTooManyRequests, http.StatusInternalServerError, http.StatusServiceUnavailable:
+            return true
+        }
+
+        // Problems with the connection or our token rather than the push.
+        switch e.Reason {
+        case "IdleTimeout", "ExpiredProviderToken", "TooManyProviderTokenUpdates":
+            return true
+        }
+        return false
+    }
+
+    switch e.Status {
+    case 1, 10, 255:
+        return true
+    case 2, 3, 4, 5, 6, 7, 8:
+        return false
+    }
+
+    // We don't know this one, so give it the benefit of the doubt.
+    return true
+}
+
+// Permanent reports whether the notification will never be accepted as is.
+func (e *APNsError) Permanent() bool {
+    return !e.Temporary()
+}
+
+// InvalidToken reports whether Apple considers the device token dead or
+// malformed, meaning the app should stop sending to it.
+func (e *APNsError) InvalidToken() bool {
+    return e.Status == 5 || e.Status == 8
+}
+
+var errText = map[uint8]string{
+    0:   "No errors encountered",
+    1:   "Processing Errors",
+    2:   "Missing Device Token",
+    3:   "Missing Topic",
+    4:   "Missing Payload",
+    5:   "Invalid Token Size",
+    6:   "Invalid Topic Size",
+    7:   "Invalid Payload Size",
+    8:   "Invalid Token",
+    10:  "Shutdown",
+    255: "None (Unknown)",
+}
+
+// Builds the error for a binary protocol status code.
+func newStatusError(status uint8, identifier uint32) *APNsError {
+    reason, ok := errText[status]
+    if !ok {
+        reason = fmt.Sprintf("Unknown error code %d", status)
+    }
+    return &APNsError{Status: status, Identifier: identifier, Reason: reason}
+}
+
+// Maps HTTP/2 reasons onto the binary status codes with the same meaning.
+var http2ReasonStatus = map[string]uint8{
+    "MissingDeviceToken":     2,
+    "MissingTopic":           3,
+    "PayloadEmpty":           4,
+    "BadTopic":               6,
+    "TopicDisallowed":        6,
+    "PayloadTooLarge":        7,
+    // The token is fine, it belongs to another app. The topic is what's
+    // wrong, so this must not mark the token as dead.
+    "DeviceTokenNotForTopic": 6,
+    "BadDeviceToken":         8,
+    "ExpiredToken":           8,
+    "Unregistered":           8,
+    "Shutdown":               10,
+    "InternalServerError":    1,
+    "ServiceUnavailable":     1,
+    "TooManyRequests":        1,
+}
+
+// Builds the error for a failed HTTP/2 request.
+func newHttp2Error(httpStatus int, reason string, identifier uint32) *APNsError {
+    status, ok := http2ReasonStatus[reason]
+    if !ok {
+        status = 255
+    }
+    return &APNsError{Status: status, Identifier: identifier, Reason: reason, HTTPStatus: httpStatus}
+}
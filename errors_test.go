@@ -0,0 +1,53 @@
+package gapless
+
+import (
+    "github.com/cojac/assert"
+    "testing"
+)
+
+func TestStatusErrorClassification(t *testing.T) {
+    err := newStatusError(8, 42)
+    assert.Equal(t, "Invalid Token", err.Error())
+    assert.Equal(t, uint32(42), err.Identifier)
+    assert.Equal(t, true, err.Permanent())
+    assert.Equal(t, true, err.InvalidToken())
+
+    err = newStatusError(10, 42)
+    assert.Equal(t, "Shutdown", err.Error())
+    assert.Equal(t, true, err.Temporary())
+    assert.Equal(t, false, err.InvalidToken())
+
+    err = newStatusError(1, 0)
+    assert.Equal(t, true, err.Temporary())
+
+    err = newStatusError(7, 0)
+    assert.Equal(t, true, err.Permanent())
+
+    err = newStatusError(99, 0)
+    assert.Equal(t, "Unknown error code 99", err.Error())
+    assert.Equal(t, true, err.Temporary())
+}
+
+func TestHttp2ErrorClassification(t *testing.T) {
+    err := newHttp2Error(410, "Unregistered", 7)
+    assert.Equal(t, uint8(8), err.Status)
+    assert.Equal(t, true, err.Permanent())
+    assert.Equal(t, true, err.InvalidToken())
+
+    // A topic mismatch mustn't get a working token thrown away.
+    err = newHttp2Error(400, "DeviceTokenNotForTopic", 7)
+    assert.Equal(t, uint8(6), err.Status)
+    assert.Equal(t, true, err.Permanent())
+    assert.Equal(t, false, err.InvalidToken())
+
+    err = newHttp2Error(503, "ServiceUnavailable", 7)
+    assert.Equal(t, true, err.Temporary())
+
+    err = newHttp2Error(403, "ExpiredProviderToken", 7)
+    assert.Equal(t, uint8(255), err.Status)
+    assert.Equal(t, true, err.Temporary())
+
+    err = newHttp2Error(403, "BadCertificate", 7)
+    assert.Equal(t, true, err.Permanent())
+    assert.Equal(t, false, err.InvalidToken())
+}
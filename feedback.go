@@ -0,0 +1,92 @@
+package gapless
+
+import (
+    "context"
+    "crypto/tls"
+    "encoding/binary"
+    "io"
+    "net"
+    "time"
+)
+
+// A device Apple told us is no longer accepting pushes for our app.
+type feedbackTuple struct {
+    timestamp time.Time
+    token     []byte
+}
+
+// Decodes feedback tuples until the server hangs up. Each tuple is a 4 byte
+// timestamp, a 2 byte token length and then the token itself.
+func readFeedback(r io.Reader) ([]feedbackTuple, error) {
+    tuples := []feedbackTuple{}
+    header := [6]byte{}
+
+    for {
+        _, err := io.ReadFull(r, header[:])
+        if err == io.EOF {
+            return tuples, nil
+        }
+        if err != nil {
+            return tuples, err
+        }
+
+        token := make([]byte, binary.BigEndian.Uint16(header[4:]))
+        _, err = io.ReadFull(r, token)
+        if err != nil {
+            return tuples, err
+        }
+
+        tuples = append(tuples, feedbackTuple{
+            timestamp: time.Unix(int64(binary.BigEndian.Uint32(header[:4])), 0).In(time.UTC),
+            token:     token,
+        })
+    }
+}
+
+// Connects to the feedback service and reads everything it has for us.
+// Apple forgets the tuples once they are read, so a single pass is enough.
+func fetchFeedback(endpoint string, tlsCfg *tls.Config) ([]feedbackTuple, error) {
+    conn, err := net.DialTimeout("tcp", endpoint, 30*time.Second)
+    if err != nil {
+        return nil, err
+    }
+
+    tlsconn := tls.Client(conn, tlsCfg)
+    defer tlsconn.Close()
+
+    tlsconn.SetDeadline(time.Now().Add(5 * time.Minute))
+    err = tlsconn.Handshake()
+    if err != nil {
+        return nil, err
+    }
+
+    return readFeedback(tlsconn)
+}
+
+// Polls the feedback service until the context is cancelled, publishing every
+// dead token it hears about.
+func runFeedback(ctx context.Context, endpoint string, tlsCfg *tls.Config, interval time.Duration, sink *tokenSink, logs *appLog) {
+    for {
+        tuples, err := fetchFeedback(endpoint, tlsCfg)
+        if err != nil {
+            logs.error("Feedback service error.", "error", err)
+        }
+
+        for _, tuple := range tuples {
+            err = sink.publish(deadToken{token: tuple.token, timestamp: tuple.timestamp, reason: "Feedback"})
+            if err != nil {
+                logs.error("Publishing feedback token failed.", "token", logs.token(tuple.token), "error", err)
+            }
+        }
+
+        if len(tuples) > 0 {
+            logs.info("Feedback service reported dead tokens.", "count", len(tuples))
+        }
+
+        select {
+        case <-ctx.Done():
+            return
+        case <-time.After(interval):
+        }
+    }
+}
@@ -0,0 +1,30 @@
+package gapless
+
+import (
+    "bytes"
+    "github.com/cojac/assert"
+    "testing"
+    "time"
+)
+
+func TestReadFeedback(t *testing.T) {
+    buf := bytes.NewBuffer([]byte{})
+    _ = bwrite(buf, uint32(1400000000), uint16(4), []byte{0xde, 0xad, 0xbe, 0xef})
+    _ = bwrite(buf, uint32(1400000060), uint16(2), []byte{0x01, 0x02})
+
+    tuples, err := readFeedback(buf)
+    assert.Equal(t, nil, err)
+    assert.Equal(t, 2, len(tuples))
+    assert.Equal(t, []byte{0xde, 0xad, 0xbe, 0xef}, tuples[0].token)
+    assert.Equal(t, time.Unix(1400000000, 0).In(time.UTC), tuples[0].timestamp)
+    assert.Equal(t, []byte{0x01, 0x02}, tuples[1].token)
+}
+
+func TestReadFeedbackTruncated(t *testing.T) {
+    buf := bytes.NewBuffer([]byte{})
+    _ = bwrite(buf, uint32(1400000000), uint16(4), []byte{0xde, 0xad})
+
+    tuples, err := readFeedback(buf)
+    assert.NotEqual(t, nil, err)
+    assert.Equal(t, 0, len(tuples))
+}
@@ -1,22 +1,80 @@
 package main
 
 import (
+    "context"
     "fmt"
     "github.com/cojac/gapless"
     "os"
+    "os/signal"
     "path/filepath"
+    "syscall"
 )
 
 func main() {
     // Config file is mandatory. Ensure one is passed in.
     if len(os.Args) < 2 {
-        fmt.Printf("Usage: %s <config-path>\n", filepath.Base(os.Args[0]))
+        fmt.Printf("Usage: %s <config-path> [app <name>] [dlq count|list|replay|purge [n]] [schedule count|cancel <identifier>]\n", filepath.Base(os.Args[0]))
         os.Exit(1)
     }
 
     // Tell gapless about our settings file.
     gapless.Settings.LoadFromFile(filepath.Clean(os.Args[1]))
 
+    err := gapless.ConfigureLogging(gapless.Settings)
+    if err != nil {
+        fmt.Fprintln(os.Stderr, err)
+        os.Exit(1)
+    }
+
+    // Managing the dead letter queue or scheduled pushes rather than running.
+    if len(os.Args) > 2 {
+        err := command(os.Args[2:])
+        if err != nil {
+            fmt.Fprintln(os.Stderr, err)
+            os.Exit(1)
+        }
+        return
+    }
+
     // Start the connections.
-    gapless.Run()
+    server, err := gapless.New(gapless.Settings)
+    if err != nil {
+        fmt.Fprintln(os.Stderr, err)
+        os.Exit(1)
+    }
+
+    // Stop cleanly when asked to, by the init script or ctrl-c.
+    ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, syscall.SIGINT)
+    defer stop()
+
+    err = server.Run(ctx)
+    if err != nil {
+        fmt.Fprintln(os.Stderr, err)
+        os.Exit(1)
+    }
+}
+
+// Runs a management command, against one of the 'apps' if asked to.
+func command(args []string) error {
+    settings := gapless.Settings
+    if args[0] == "app" {
+        if len(args) < 3 {
+            return fmt.Errorf("Expected an app name and a command.")
+        }
+
+        var err error
+        settings, err = gapless.AppSettings(settings, args[1])
+        if err != nil {
+            return err
+        }
+        args = args[2:]
+    }
+
+    switch args[0] {
+    case "dlq":
+        return gapless.DeadLetterCommand(settings, args[1:], os.Stdout)
+    case "schedule":
+        return gapless.ScheduleCommand(settings, args[1:], os.Stdout)
+    }
+    return fmt.Errorf("Unknown command: %s", args[0])
 }
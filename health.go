@@ -0,0 +1,190 @@
+package gapless
+
+import (
+    "context"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "github.com/gosexy/redis"
+    "net/http"
+    "sort"
+    "sync/atomic"
+    "time"
+)
+
+// The state of a single dependency, as reported by /healthz and /readyz.
+type dependencyCheck struct {
+    OK    bool   `json:"ok"`
+    Error string `json:"error,omitempty"`
+}
+
+func newDependencyCheck(err error) dependencyCheck {
+    if err != nil {
+        return dependencyCheck{OK: false, Error: err.Error()}
+    }
+    return dependencyCheck{OK: true}
+}
+
+// The body of both endpoints.
+type healthReport struct {
+    Status string                                `json:"status"`
+    Apps   map[string]map[string]dependencyCheck `json:"apps"`
+}
+
+// Pings redis until the context is cancelled, so the checks below know
+// whether it's still there. Uses its own redis connection.
+func checkRedis(ctx context.Context, client *redis.Client, interval time.Duration, stats *serviceStats) {
+    for {
+        _, err := client.Ping()
+        stats.redisChecked(err)
+
+        select {
+        case <-ctx.Done():
+            return
+        case <-time.After(interval):
+        }
+    }
+}
+
+// A Source reporting how every call to it went, so readiness reflects the
+// redis connections the pipeline actually uses and not just the one pinging.
+type watchedSource struct {
+    Source
+    stats *serviceStats
+}
+
+func (s *watchedSource) Receive() (*Message, error) {
+    msg, err := s.Source.Receive()
+    s.stats.sourceUsed("Receive", err)
+    return msg, err
+}
+
+func (s *watchedSource) Ack(msg *Message) error {
+    err := s.Source.Ack(msg)
+    s.stats.sourceUsed("Ack", err)
+    return err
+}
+
+func (s *watchedSource) Requeue(msg *Message, body string, at time.Time) error {
+    err := s.Source.Requeue(msg, body, at)
+    s.stats.sourceUsed("Requeue", err)
+    return err
+}
+
+func (s *watchedSource) Schedule(msg *Message, at time.Time, identifier uint32) error {
+    err := s.Source.Schedule(msg, at, identifier)
+    s.stats.sourceUsed("Schedule", err)
+    return err
+}
+
+// Whether the last call of each kind to the app's source worked.
+func (s *serviceStats) sourceHealth() error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    if len(s.sourceErrs) == 0 {
+        return errors.New("Not used yet.")
+    }
+
+    calls := []string{}
+    for call := range s.sourceErrs {
+        calls = append(calls, call)
+    }
+    sort.Strings(calls)
+
+    for _, call := range calls {
+        if err := s.sourceErrs[call]; err != nil {
+            return errors.New(fmt.Sprintf("%s failed: %s.", call, err))
+        }
+    }
+    return nil
+}
+
+// Whether redis answered the last ping, and recently enough.
+func (s *serviceStats) redisHealth(interval time.Duration) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    if s.redisCheckedAt.IsZero() {
+        return errors.New("Not connected yet.")
+    }
+    if s.redisErr != nil {
+        return errors.New(fmt.Sprintf("Ping failed: %s.", s.redisErr))
+    }
+    // A ping which hangs never reports back at all.
+    if age := time.Since(s.redisCheckedAt); age > 3*interval {
+        return errors.New(fmt.Sprintf("No answer to a ping for %s.", age.Truncate(time.Second)))
+    }
+    return nil
+}
+
+// Whether any pooled connection has completed a TLS handshake, and whether
+// that or a push Apple accepted was within maxAge, unless that's zero.
+func (s *serviceStats) apnsHealth(maxAge time.Duration) error {
+    last := atomic.LoadInt64(&s.lastHandshake)
+    if last == 0 {
+        return errors.New("No connection has completed a TLS handshake yet.")
+    }
+    if sent := atomic.LoadInt64(&s.lastSent); sent > last {
+        last = sent
+    }
+    if age := time.Since(time.Unix(0, last)); maxAge > 0 && age > maxAge {
+        return errors.New(fmt.Sprintf("No TLS handshake or accepted push for %s.", age.Truncate(time.Second)))
+    }
+    return nil
+}
+
+// Checks every app's dependencies, returning whether they are all fine. The
+// apps' stats are looked up with statsOf (statsFor, outside of tests). Apps in
+// ownSource take their notifications from a Source given with UseSource, so
+// redis isn't pinged for them.
+func checkHealth(apps map[string]*DictObj, statsOf func(name string) *serviceStats, ownSource map[string]bool) (bool, healthReport) {
+    report := healthReport{Status: "ok", Apps: make(map[string]map[string]dependencyCheck)}
+    ok := true
+
+    names := []string{}
+    for name := range apps {
+        names = append(names, name)
+    }
+    sort.Strings(names)
+
+    for _, name := range names {
+        settings := apps[name]
+        stats := statsOf(name)
+
+        interval := time.Duration(settings.Float("health_interval", 5) * float64(time.Second))
+        maxAge := time.Duration(settings.Float("ready_handshake_age", 0) * float64(time.Second))
+        checks := map[string]dependencyCheck{
+            "redis":  newDependencyCheck(stats.redisHealth(interval)),
+            "source": newDependencyCheck(stats.sourceHealth()),
+            "apns":   newDependencyCheck(stats.apnsHealth(maxAge)),
+        }
+        if ownSource[name] {
+            delete(checks, "redis")
+        }
+        for _, check := range checks {
+            ok = ok && check.OK
+        }
+        report.Apps[name] = checks
+    }
+
+    if !ok {
+        report.Status = "failing"
+    }
+    return ok, report
+}
+
+// Serves /healthz, which only says the process is alive, and /readyz, which
+// fails with a 503 while any app's redis, source or apns connections are
+// down. Both describe every dependency.
+func healthHandler(apps map[string]*DictObj, statsOf func(name string) *serviceStats, ownSource map[string]bool, readiness bool) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        ok, report := checkHealth(apps, statsOf, ownSource)
+
+        w.Header().Set("Content-Type", "application/json")
+        if readiness && !ok {
+            w.WriteHeader(http.StatusServiceUnavailable)
+        }
+        json.NewEncoder(w).Encode(report)
+    })
+}
@@ -0,0 +1,119 @@
+package gapless
+
+import (
+    "encoding/json"
+    "errors"
+    "github.com/cojac/assert"
+    "net/http"
+    "net/http/httptest"
+    "sync/atomic"
+    "testing"
+    "time"
+)
+
+func TestHealthHandler(t *testing.T) {
+    apps := map[string]*DictObj{"health-test": NewSettingsObj()}
+    stats := newServiceStats()
+    statsOf := func(string) *serviceStats { return stats }
+
+    get := func(path string, handler http.Handler) (int, healthReport) {
+        w := httptest.NewRecorder()
+        handler.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+
+        report := healthReport{}
+        err := json.Unmarshal(w.Body.Bytes(), &report)
+        assert.Equal(t, nil, err)
+        return w.Code, report
+    }
+
+    // Nothing is connected yet, but we are alive.
+    code, report := get("/healthz", healthHandler(apps, statsOf, nil, false))
+    assert.Equal(t, http.StatusOK, code)
+    assert.Equal(t, "failing", report.Status)
+
+    code, report = get("/readyz", healthHandler(apps, statsOf, nil, true))
+    assert.Equal(t, http.StatusServiceUnavailable, code)
+    assert.Equal(t, "Not connected yet.", report.Apps["health-test"]["redis"].Error)
+    assert.Equal(t, "Not used yet.", report.Apps["health-test"]["source"].Error)
+    assert.Equal(t, "No connection has completed a TLS handshake yet.", report.Apps["health-test"]["apns"].Error)
+
+    stats.redisChecked(nil)
+    stats.sourceUsed("Receive", nil)
+    stats.connected(false)
+    code, report = get("/readyz", healthHandler(apps, statsOf, nil, true))
+    assert.Equal(t, http.StatusOK, code)
+    assert.Equal(t, "ok", report.Status)
+
+    stats.redisChecked(errors.New("EOF"))
+    code, report = get("/readyz", healthHandler(apps, statsOf, nil, true))
+    assert.Equal(t, http.StatusServiceUnavailable, code)
+    assert.Equal(t, dependencyCheck{OK: false, Error: "Ping failed: EOF."}, report.Apps["health-test"]["redis"])
+    assert.Equal(t, true, report.Apps["health-test"]["apns"].OK)
+
+    // The pipeline's own connection failing counts too, whatever the pings
+    // say, until it works again.
+    stats.redisChecked(nil)
+    stats.sourceUsed("Ack", errors.New("EOF"))
+    stats.sourceUsed("Receive", nil)
+    code, report = get("/readyz", healthHandler(apps, statsOf, nil, true))
+    assert.Equal(t, http.StatusServiceUnavailable, code)
+    assert.Equal(t, dependencyCheck{OK: false, Error: "Ack failed: EOF."}, report.Apps["health-test"]["source"])
+
+    stats.sourceUsed("Ack", nil)
+    code, _ = get("/readyz", healthHandler(apps, statsOf, nil, true))
+    assert.Equal(t, http.StatusOK, code)
+}
+
+func TestHealthOwnSource(t *testing.T) {
+    apps := map[string]*DictObj{"own": NewSettingsObj()}
+    stats := newServiceStats()
+    stats.sourceUsed("Receive", nil)
+    stats.connected(false)
+
+    // Redis is never pinged for an app with a source of its own.
+    ok, report := checkHealth(apps, func(string) *serviceStats { return stats }, map[string]bool{"own": true})
+    assert.Equal(t, true, ok)
+    _, present := report.Apps["own"]["redis"]
+    assert.Equal(t, false, present)
+}
+
+// Long lived connections on an idle queue stay ready unless told otherwise.
+func TestHealthHandshakeAgeDefault(t *testing.T) {
+    apps := map[string]*DictObj{"idle": NewSettingsObj()}
+    stats := newServiceStats()
+    stats.redisChecked(nil)
+    stats.sourceUsed("Receive", nil)
+    atomic.StoreInt64(&stats.lastHandshake, time.Now().Add(-48*time.Hour).UnixNano())
+
+    ok, _ := checkHealth(apps, func(string) *serviceStats { return stats }, nil)
+    assert.Equal(t, true, ok)
+
+    apps["idle"].Set("ready_handshake_age", float64(3600))
+    ok, report := checkHealth(apps, func(string) *serviceStats { return stats }, nil)
+    assert.Equal(t, false, ok)
+    assert.Equal(t, false, report.Apps["idle"]["apns"].OK)
+}
+
+func TestApnsHealthAge(t *testing.T) {
+    stats := newServiceStats()
+    atomic.StoreInt64(&stats.lastHandshake, time.Now().Add(-2*time.Hour).UnixNano())
+
+    assert.Equal(t, nil, stats.apnsHealth(0))
+    assert.NotEqual(t, nil, stats.apnsHealth(time.Hour))
+
+    // A push Apple accepted shows the connection still works.
+    stats.delivered()
+    assert.Equal(t, nil, stats.apnsHealth(time.Hour))
+    assert.Equal(t, int64(1), stats.sent)
+}
+
+func TestWatchedSource(t *testing.T) {
+    stats := newServiceStats()
+    source := &watchedSource{Source: &fakeSource{pending: []string{"{}"}}, stats: stats}
+
+    msg, err := source.Receive()
+    assert.Equal(t, nil, err)
+    assert.Equal(t, nil, source.Ack(msg))
+    assert.Equal(t, nil, stats.sourceHealth())
+    assert.Equal(t, 2, len(stats.sourceErrs))
+}
@@ -0,0 +1,171 @@
+package gapless
+
+import (
+    "bytes"
+    "crypto/tls"
+    "encoding/hex"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "io"
+    "net/http"
+    "strconv"
+    "sync/atomic"
+    "time"
+)
+
+// Connection object which talks to Apple's HTTP/2 provider API.
+// Each object owns its own transport, and therefore its own TCP connection,
+// so the pool size still maps to the number of open connections.
+type apnsHttp2Conn struct {
+    client           *http.Client
+    transport        *http.Transport
+    endpoint         string
+    topic            string
+    signer           *apnsTokenSigner
+    MAX_PAYLOAD_SIZE int
+    // Called after every successful handshake, reconnect is false the first time.
+    onConnect        func(reconnect bool)
+    handshakes       int32
+}
+
+// When signer is set the connection uses token based authentication and the
+// TLS config doesn't need a client certificate.
+func newApnsHttp2Client(endpoint string, tlsCfg *tls.Config, topic string, signer *apnsTokenSigner) (*apnsHttp2Conn, error) {
+    if len(tlsCfg.Certificates) == 0 && signer == nil {
+        return nil, errors.New("HTTP/2 connections need either a certificate or a signing key.")
+    }
+
+    transport := &http.Transport{
+        TLSClientConfig:   tlsCfg.Clone(),
+        ForceAttemptHTTP2: true,
+    }
+
+    apnsConn := &apnsHttp2Conn{
+        client: &http.Client{
+            Transport: transport,
+            Timeout:   30 * time.Second,
+        },
+        transport:        transport,
+        endpoint:         endpoint,
+        topic:            topic,
+        signer:           signer,
+        MAX_PAYLOAD_SIZE: 4096,
+    }
+
+    // The transport dials for us, so hear about its handshakes through the
+    // last check it makes of every connection.
+    verify := transport.TLSClientConfig.VerifyConnection
+    transport.TLSClientConfig.VerifyConnection = func(state tls.ConnectionState) error {
+        if verify != nil {
+            err := verify(state)
+            if err != nil {
+                return err
+            }
+        }
+
+        handshakes := atomic.AddInt32(&apnsConn.handshakes, 1)
+        if apnsConn.onConnect != nil {
+            apnsConn.onConnect(handshakes > 1)
+        }
+        return nil
+    }
+
+    return apnsConn, nil
+}
+
+// Connects ahead of the first send. The transport only dials for a request,
+// so this makes one. Whatever Apple answers, we're connected once it has.
+func (client *apnsHttp2Conn) warmUp() error {
+    resp, err := client.client.Get("https://" + client.endpoint + "/")
+    if err != nil {
+        return err
+    }
+    return resp.Body.Close()
+}
+
+func (client *apnsHttp2Conn) shutdown() (err error) {
+    client.transport.CloseIdleConnections()
+    return nil
+}
+
+// The apns-id header has to be a UUID. We embed the identifier in the last
+// group so it can still be matched up with the logs on Apple's side.
+func http2ApnsId(identity uint32) string {
+    return fmt.Sprintf("00000000-0000-0000-0000-%012x", identity)
+}
+
+// SendPayload sends push to the device via the HTTP/2 provider API.
+// Unlike the binary protocol, Apple answers every request so the result is
+// already waiting in the channel when the call returns.
+func (client *apnsHttp2Conn) SendPayload(token, payload []byte, expiration time.Time, identity uint32, priority uint8) <-chan error {
+    result := make(chan error, 1)
+    result <- client.send(token, payload, expiration, identity, priority)
+    return result
+}
+
+func (client *apnsHttp2Conn) send(token, payload []byte, expiration time.Time, identity uint32, priority uint8) (err error) {
+    if len(payload) > client.MAX_PAYLOAD_SIZE {
+        return &APNsError{
+            Status:     7,
+            Identifier: identity,
+            Reason:     fmt.Sprintf("The payload exceeds maximum allowed. It was: %d", len(payload)),
+        }
+    }
+
+    url := "https://" + client.endpoint + "/3/device/" + hex.EncodeToString(token)
+    req, err := http.NewRequest("POST", url, bytes.NewReader(payload))
+    if err != nil {
+        return err
+    }
+
+    // A zero expiration tells Apple to try once and then discard it.
+    expirationTime := int64(0)
+    if !expiration.IsZero() {
+        expirationTime = expiration.Unix()
+    }
+
+    req.Header.Set("content-type", "application/json")
+    req.Header.Set("apns-id", http2ApnsId(identity))
+    req.Header.Set("apns-expiration", strconv.FormatInt(expirationTime, 10))
+    if priority != 0 {
+        req.Header.Set("apns-priority", strconv.Itoa(int(priority)))
+    }
+    if client.topic != "" {
+        req.Header.Set("apns-topic", client.topic)
+    }
+    if client.signer != nil {
+        bearer, err := client.signer.Token()
+        if err != nil {
+            return err
+        }
+        req.Header.Set("authorization", "bearer "+bearer)
+    }
+
+    resp, err := client.client.Do(req)
+    if err != nil {
+        return err
+    }
+    defer resp.Body.Close()
+
+    if resp.StatusCode == http.StatusOK {
+        io.Copy(io.Discard, resp.Body)
+        return nil
+    }
+
+    body := struct {
+        Reason    string `json:"reason"`
+        Timestamp int64  `json:"timestamp"`
+    }{}
+    err = json.NewDecoder(resp.Body).Decode(&body)
+    if err != nil {
+        return newHttp2Error(resp.StatusCode, fmt.Sprintf("Unreadable error response: %s", err), identity)
+    }
+
+    // Apple's clock disagrees with ours, mint a fresh token for the next try.
+    if body.Reason == "ExpiredProviderToken" && client.signer != nil {
+        client.signer.Expire()
+    }
+
+    return newHttp2Error(resp.StatusCode, body.Reason, identity)
+}
@@ -0,0 +1,66 @@
+package gapless
+
+import (
+    "github.com/cojac/assert"
+    "github.com/cojac/gapless/apnstest"
+    "testing"
+    "time"
+)
+
+func TestHttp2SendPayload(t *testing.T) {
+    s := apnstest.NewHTTP2Server()
+    defer s.Close()
+
+    conn, err := newApnsHttp2Client(s.Addr, s.ClientTLSConfig(), "com.example.app", nil)
+    assert.Equal(t, nil, err)
+    defer conn.shutdown()
+
+    err = <-conn.SendPayload([]byte{0xab, 0xcd}, []byte(`{"aps":{}}`), time.Time{}, 77, 5)
+    assert.Equal(t, nil, err)
+
+    received := s.Notifications()
+    assert.Equal(t, 1, len(received))
+    assert.Equal(t, []byte{0xab, 0xcd}, received[0].Token)
+    assert.Equal(t, uint32(77), received[0].Identifier)
+    assert.Equal(t, uint32(0), received[0].Expiration)
+    assert.Equal(t, uint8(5), received[0].Priority)
+    assert.Equal(t, "com.example.app", received[0].Topic)
+}
+
+func TestHttp2SendPayloadRejected(t *testing.T) {
+    s := apnstest.NewHTTP2Server()
+    defer s.Close()
+
+    s.Handle(func(n apnstest.Notification) apnstest.Response {
+        return apnstest.Response{Reason: "Unregistered"}
+    })
+
+    conn, err := newApnsHttp2Client(s.Addr, s.ClientTLSConfig(), "", nil)
+    assert.Equal(t, nil, err)
+    defer conn.shutdown()
+
+    err = <-conn.SendPayload([]byte{0xab}, []byte("{}"), time.Now().Add(time.Hour), 1, 0)
+    assert.Equal(t, newHttp2Error(410, "Unregistered", 1), err)
+    assert.Equal(t, 1, len(s.Rejected()))
+}
+
+func TestHttp2TokenAuth(t *testing.T) {
+    s := apnstest.NewHTTP2Server()
+    defer s.Close()
+
+    _, path := writeTestSigningKey(t)
+    signer, _ := loadApnsTokenSigner(path, "ABC123DEFG", "DEF123GHIJ")
+
+    cfg := s.ClientTLSConfig()
+    cfg.Certificates = nil
+
+    conn, err := newApnsHttp2Client(s.Addr, cfg, "com.example.app", signer)
+    assert.Equal(t, nil, err)
+    defer conn.shutdown()
+
+    err = <-conn.SendPayload([]byte{0xab}, []byte("{}"), time.Now().Add(time.Hour), 1, 0)
+    assert.Equal(t, nil, err)
+
+    token, _ := signer.Token()
+    assert.Equal(t, token, s.Notifications()[0].Bearer)
+}
@@ -0,0 +1,110 @@
+package gapless
+
+import (
+    "sync"
+    "time"
+)
+
+// Items popped off the queues and not yet dealt with. Whatever is still here
+// once the shutdown deadline passes is taken back and returned to its queue.
+type inFlightSet struct {
+    mu    sync.Mutex
+    items map[*inFlightItem]bool
+    // Broadcast whenever an item is done with.
+    doneWith *sync.Cond
+}
+
+type inFlightItem struct {
+    source Source
+    msg    *Message
+    // Set once the item is claimed, either to act on its outcome or to take
+    // it back. Only the first claim wins.
+    claimed bool
+}
+
+func newInFlightSet() *inFlightSet {
+    s := &inFlightSet{items: make(map[*inFlightItem]bool)}
+    s.doneWith = sync.NewCond(&s.mu)
+    return s
+}
+
+func (s *inFlightSet) add(source Source, msg *Message) *inFlightItem {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    item := &inFlightItem{source: source, msg: msg}
+    s.items[item] = true
+    return item
+}
+
+// Claims an item to act on its outcome. False when it has been taken back.
+func (s *inFlightSet) claim(item *inFlightItem) bool {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    if item.claimed {
+        return false
+    }
+    item.claimed = true
+    return true
+}
+
+// Whether an item nobody acted on yet has been taken back.
+func (s *inFlightSet) takenBack(item *inFlightItem) bool {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    return item.claimed
+}
+
+// Forgets an item, however it was dealt with.
+func (s *inFlightSet) done(item *inFlightItem) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    delete(s.items, item)
+    s.doneWith.Broadcast()
+}
+
+func (s *inFlightSet) count() int {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    return len(s.items)
+}
+
+// Waits for every item to be done with, returning false if the timeout came
+// first. Items may still be added meanwhile, they are waited for too.
+func (s *inFlightSet) wait(timeout time.Duration) bool {
+    finished := make(chan struct{})
+    go func() {
+        s.mu.Lock()
+        for len(s.items) > 0 {
+            s.doneWith.Wait()
+        }
+        s.mu.Unlock()
+        close(finished)
+    }()
+
+    select {
+    case <-finished:
+        return true
+    case <-time.After(timeout):
+        return false
+    }
+}
+
+// Claims and returns every item which hasn't been claimed yet.
+func (s *inFlightSet) takeBack() []*inFlightItem {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    taken := []*inFlightItem{}
+    for item := range s.items {
+        if !item.claimed {
+            item.claimed = true
+            taken = append(taken, item)
+        }
+    }
+    return taken
+}
@@ -0,0 +1,61 @@
+package gapless
+
+import (
+    "github.com/cojac/assert"
+    "testing"
+    "time"
+)
+
+func TestInFlightSetWait(t *testing.T) {
+    inFlight := newInFlightSet()
+    assert.Equal(t, true, inFlight.wait(time.Millisecond))
+
+    item := inFlight.add(nil, &Message{Body: "a"})
+    assert.Equal(t, 1, inFlight.count())
+    assert.Equal(t, false, inFlight.wait(10*time.Millisecond))
+
+    go func() {
+        time.Sleep(10 * time.Millisecond)
+        inFlight.claim(item)
+        inFlight.done(item)
+    }()
+    assert.Equal(t, true, inFlight.wait(time.Second))
+    assert.Equal(t, 0, inFlight.count())
+}
+
+func TestInFlightSetTakeBack(t *testing.T) {
+    inFlight := newInFlightSet()
+
+    finished := inFlight.add(nil, &Message{Body: "a"})
+    unfinished := inFlight.add(nil, &Message{Body: "b"})
+    assert.Equal(t, true, inFlight.claim(finished))
+
+    taken := inFlight.takeBack()
+    assert.Equal(t, 1, len(taken))
+    assert.Equal(t, "b", taken[0].msg.Body)
+
+    // Whoever was still working on it finds out it's gone.
+    assert.Equal(t, true, inFlight.takenBack(unfinished))
+    assert.Equal(t, false, inFlight.claim(unfinished))
+    assert.Equal(t, 0, len(inFlight.takeBack()))
+}
+
+func TestInFlightSetAddWhileWaiting(t *testing.T) {
+    inFlight := newInFlightSet()
+    first := inFlight.add(nil, &Message{Body: "a"})
+
+    // Added after the wait started, and done with last.
+    waited := make(chan bool)
+    go func() { waited <- inFlight.wait(time.Second) }()
+    second := inFlight.add(nil, &Message{Body: "b"})
+    inFlight.done(first)
+
+    select {
+    case <-waited:
+        t.Fatal("The wait finished with an item in flight.")
+    case <-time.After(10 * time.Millisecond):
+    }
+
+    inFlight.done(second)
+    assert.Equal(t, true, <-waited)
+}
@@ -0,0 +1,180 @@
+package gapless
+
+import (
+    "errors"
+    "fmt"
+)
+
+// One of the redis lists we consume from, along with the sorted sets holding
+// its retries and scheduled pushes.
+type queueLane struct {
+    queue     *redisQueue
+    weight    int
+    retries   *delayedSet
+    scheduled *delayedSet
+}
+
+// The lanes we consume from, highest priority first.
+//
+// In strict mode a lane is only popped from once every lane before it is
+// empty. In weighted mode the lanes take turns in proportion to their weights
+// (smooth weighted round robin), and the others are only looked at when the
+// lane whose turn it is has nothing waiting.
+type queueLanes struct {
+    lanes    []*queueLane
+    weighted bool
+    client   redisClient
+    current  []int
+}
+
+func newQueueLanes(client redisClient, lanes []*queueLane, weighted bool) *queueLanes {
+    return &queueLanes{lanes: lanes, weighted: weighted, client: client, current: make([]int, len(lanes))}
+}
+
+// Returns the index of the lane whose turn it is. Over any run of total weight
+// picks every lane comes up exactly weight times, spread out as evenly as possible.
+func (l *queueLanes) next() int {
+    total, best := 0, 0
+    for x, lane := range l.lanes {
+        l.current[x] += lane.weight
+        total += lane.weight
+        if l.current[x] > l.current[best] {
+            best = x
+        }
+    }
+    l.current[best] -= total
+    return best
+}
+
+// The lanes in the order they should be looked at for the next pop.
+func (l *queueLanes) order() []*queueLane {
+    if !l.weighted {
+        return l.lanes
+    }
+
+    first := l.next()
+    order := append([]*queueLane{l.lanes[first]}, l.lanes[:first]...)
+    return append(order, l.lanes[first+1:]...)
+}
+
+// Blocks until an item is available on any lane and returns it with its lane.
+// Returns a nil lane when nothing came within the pop timeout.
+//
+// Without reliable mode a single BLPOP over every key does the job, redis
+// takes from the first non empty one. BLMOVE only takes one key though, so
+// reliable mode looks at each lane in turn and, when they are all empty, waits
+// on the first one.
+func (l *queueLanes) pop() (*queueLane, string, error) {
+    if len(l.lanes) == 1 {
+        raw, err := l.lanes[0].queue.pop()
+        if err != nil || raw == "" {
+            return nil, "", err
+        }
+        return l.lanes[0], raw, nil
+    }
+
+    order := l.order()
+    if !l.lanes[0].queue.reliable {
+        keys := make([]string, len(order))
+        for x, lane := range order {
+            keys[x] = lane.queue.key
+        }
+
+        item, err := l.client.BLPop(popTimeout, keys...)
+        if isNilReply(err) {
+            return nil, "", nil
+        }
+        if err != nil || len(item) == 0 {
+            return nil, "", err
+        }
+        if len(item) < 2 {
+            return nil, "", errors.New(fmt.Sprintf("Unexpected BLPop reply: %v", item))
+        }
+        for _, lane := range order {
+            if lane.queue.key == item[0] {
+                return lane, item[1], nil
+            }
+        }
+        return nil, "", errors.New(fmt.Sprintf("BLPop replied from an unknown key: %s", item[0]))
+    }
+
+    for _, lane := range order {
+        raw, err := lane.queue.tryPop()
+        if err != nil {
+            return nil, "", err
+        }
+        if raw != "" {
+            return lane, raw, nil
+        }
+    }
+
+    raw, err := order[0].queue.pop()
+    if err != nil || raw == "" {
+        return nil, "", err
+    }
+    return order[0], raw, nil
+}
+
+// Reads the lane keys and weights out of a 'redis_queue_keys' setting. Each
+// entry is either a key, or an object with a "key" and an optional "weight"
+// (1 by default).
+func parseQueueLanes(entries []interface{}) ([]string, []int, error) {
+    keys := []string{}
+    weights := []int{}
+
+    for _, entry := range entries {
+        key, weight := "", 1
+
+        switch value := entry.(type) {
+        case string:
+            key = value
+        case map[string]interface{}:
+            key, _ = value["key"].(string)
+            if raw, present := value["weight"]; present {
+                w, ok := raw.(float64)
+                if !ok || w < 1 || w != float64(int(w)) {
+                    return nil, nil, errors.New(fmt.Sprintf("Queue weights must be whole numbers of at least 1: %v.", entry))
+                }
+                weight = int(w)
+            }
+        }
+
+        if key == "" {
+            return nil, nil, errors.New(fmt.Sprintf("Invalid 'redis_queue_keys' entry: %v.", entry))
+        }
+        keys = append(keys, key)
+        weights = append(weights, weight)
+    }
+
+    if len(keys) == 0 {
+        return nil, nil, errors.New("The 'redis_queue_keys' setting must list at least one key.")
+    }
+    return keys, weights, nil
+}
+
+// The configured queue keys and their weights, highest priority first. Either
+// 'redis_queue_keys' or the single 'redis_queue_key'.
+func queueKeys(settings *DictObj) ([]string, []int, error) {
+    entries, err := settings.List("redis_queue_keys")
+    if err != nil {
+        return nil, nil, err
+    }
+    if entries != nil {
+        return parseQueueLanes(entries)
+    }
+
+    key := settings.String("redis_queue_key", "")
+    if key == "" {
+        return nil, nil, errors.New("The 'redis_queue_key' (or 'redis_queue_keys') must be defined in your settings.")
+    }
+    return []string{key}, []int{1}, nil
+}
+
+// The sorted sets holding a lane's retries and scheduled pushes. The
+// 'retry_key' and 'schedule_key' settings only apply when there is one lane.
+func delayedKeys(settings *DictObj, key string, single bool) (retryKey, scheduleKey string) {
+    if !single {
+        return key + ":retry", key + ":scheduled"
+    }
+    return settings.String("retry_key", key+":retry"), settings.String("schedule_key", key+":scheduled")
+}
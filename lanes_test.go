@@ -0,0 +1,97 @@
+package gapless
+
+import (
+    "encoding/json"
+    "github.com/cojac/assert"
+    "testing"
+)
+
+func testLanes(weighted bool, weights ...int) *queueLanes {
+    lanes := []*queueLane{}
+    for _, weight := range weights {
+        lanes = append(lanes, &queueLane{weight: weight})
+    }
+    return newQueueLanes(nil, lanes, weighted)
+}
+
+func TestQueueLanesStrict(t *testing.T) {
+    lanes := testLanes(false, 5, 1)
+
+    for x := 0; x < 4; x++ {
+        order := lanes.order()
+        assert.Equal(t, lanes.lanes[0], order[0])
+        assert.Equal(t, lanes.lanes[1], order[1])
+    }
+}
+
+func TestQueueLanesWeighted(t *testing.T) {
+    lanes := testLanes(true, 3, 1)
+
+    picks := []int{}
+    for x := 0; x < 8; x++ {
+        picks = append(picks, lanes.next())
+    }
+    assert.Equal(t, []int{0, 0, 1, 0, 0, 0, 1, 0}, picks)
+
+    // Whoever's turn it is goes first, the rest follow in priority order.
+    lanes = testLanes(true, 1, 1, 1)
+    lanes.next()
+    order := lanes.order()
+    assert.Equal(t, 3, len(order))
+    assert.Equal(t, lanes.lanes[1], order[0])
+    assert.Equal(t, lanes.lanes[0], order[1])
+    assert.Equal(t, lanes.lanes[2], order[2])
+}
+
+func TestParseQueueLanes(t *testing.T) {
+    entries := []interface{}{}
+    _ = json.Unmarshal([]byte(`["push:2fa", {"key": "push:news", "weight": 3}, {"key": "push:marketing"}]`), &entries)
+
+    keys, weights, err := parseQueueLanes(entries)
+    assert.Equal(t, nil, err)
+    assert.Equal(t, []string{"push:2fa", "push:news", "push:marketing"}, keys)
+    assert.Equal(t, []int{1, 3, 1}, weights)
+
+    _, _, err = parseQueueLanes([]interface{}{map[string]interface{}{"weight": float64(2)}})
+    assert.NotEqual(t, nil, err)
+
+    _, _, err = parseQueueLanes([]interface{}{map[string]interface{}{"key": "a", "weight": float64(0)}})
+    assert.NotEqual(t, nil, err)
+
+    _, _, err = parseQueueLanes([]interface{}{})
+    assert.NotEqual(t, nil, err)
+}
+
+func TestQueueKeysMistyped(t *testing.T) {
+    settings := NewSettingsObj()
+    settings.Set("redis_queue_keys", "push:2fa")
+
+    _, _, err := queueKeys(settings)
+    assert.Equal(t, "The 'redis_queue_keys' must be a list, not string.", err.Error())
+}
+
+func TestQueueLanesPop(t *testing.T) {
+    for _, reliable := range []bool{false, true} {
+        client := newFakeRedis()
+        lanes := newQueueLanes(client, []*queueLane{
+            {queue: newRedisQueue(client, client, "push:2fa", reliable, "one", newAppLog("test")), weight: 1},
+            {queue: newRedisQueue(client, client, "push:news", reliable, "one", newAppLog("test")), weight: 1},
+        }, false)
+        client.RPush("push:news", "b")
+        client.RPush("push:2fa", "a")
+
+        lane, raw, err := lanes.pop()
+        assert.Equal(t, nil, err)
+        assert.Equal(t, "a", raw)
+        assert.Equal(t, "push:2fa", lane.queue.key)
+
+        lane, raw, _ = lanes.pop()
+        assert.Equal(t, "b", raw)
+
+        // Timing out with nothing to pop isn't an error.
+        lane, raw, err = lanes.pop()
+        assert.Equal(t, nil, err)
+        assert.Equal(t, true, lane == nil)
+        assert.Equal(t, "", raw)
+    }
+}
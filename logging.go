@@ -0,0 +1,342 @@
+package gapless
+
+import (
+    "bytes"
+    "context"
+    "crypto/sha256"
+    "encoding/hex"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "io"
+    "log/slog"
+    "os"
+    "path/filepath"
+    "runtime"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+)
+
+// How everything is logged, see ConfigureLogging.
+var logging = struct {
+    sync.Mutex
+    handler slog.Handler
+    redact  string
+}{handler: newSplitHandler(newTextHandler(os.Stdout, slog.LevelInfo), newTextHandler(os.Stderr, slog.LevelInfo))}
+
+// ConfigureLogging sets up logging for the whole process from the
+// 'log_format', 'log_level' and 'log_redact' settings. The gapless binary
+// calls it, embedders can leave it out to keep the defaults. Loggers made
+// before keep logging the way they did.
+func ConfigureLogging(settings *DictObj) error {
+    handler, err := newLogHandler(settings.String("log_format", "text"), settings.String("log_level", "info"), os.Stdout, os.Stderr)
+    if err != nil {
+        return err
+    }
+
+    redact, err := redactSetting(settings)
+    if err != nil {
+        return err
+    }
+
+    logging.Lock()
+    defer logging.Unlock()
+
+    logging.handler = handler
+    logging.redact = redact
+    return nil
+}
+
+// The 'log_redact' setting, checked.
+func redactSetting(settings *DictObj) (string, error) {
+    redact := settings.String("log_redact", "none")
+    switch redact {
+    case "none", "truncate", "hash":
+        return redact, nil
+    }
+    return "", errors.New(fmt.Sprintf("Unknown 'log_redact' (%s), expected 'none', 'truncate' or 'hash'.", redact))
+}
+
+// Debug and info go to out, warnings and errors to errOut.
+func newLogHandler(format, level string, out, errOut io.Writer) (slog.Handler, error) {
+    var minLevel slog.Level
+    err := minLevel.UnmarshalText([]byte(level))
+    if err != nil {
+        return nil, errors.New(fmt.Sprintf("Unknown 'log_level' (%s), expected 'debug', 'info', 'warn' or 'error'.", level))
+    }
+
+    switch format {
+    case "text":
+        return newSplitHandler(newTextHandler(out, minLevel), newTextHandler(errOut, minLevel)), nil
+    case "logfmt":
+        opts := &slog.HandlerOptions{Level: minLevel}
+        return newSplitHandler(slog.NewTextHandler(out, opts), slog.NewTextHandler(errOut, opts)), nil
+    case "json":
+        opts := &slog.HandlerOptions{Level: minLevel}
+        return newSplitHandler(slog.NewJSONHandler(out, opts), slog.NewJSONHandler(errOut, opts)), nil
+    }
+    return nil, errors.New(fmt.Sprintf("Unknown 'log_format' (%s), expected 'text', 'logfmt' or 'json'.", format))
+}
+
+// A logger which is only used for its redaction, as configured by the
+// 'log_redact' setting, see token and payload.
+func newRedactor(settings *DictObj) (*appLog, error) {
+    redact, err := redactSetting(settings)
+    if err != nil {
+        return nil, err
+    }
+
+    logs := newAppLog("")
+    logs.redact = redact
+    return logs, nil
+}
+
+// An app's logger. Everything an app's pipeline logs carries its name, so
+// several apps can share one process (and one log).
+type appLog struct {
+    handler slog.Handler
+    // How tokens and payloads are logged, see token and payload.
+    redact string
+}
+
+func newAppLog(name string) *appLog {
+    logging.Lock()
+    defer logging.Unlock()
+
+    logs := &appLog{handler: logging.handler, redact: logging.redact}
+    if name != "" {
+        logs = logs.with("app", name)
+    }
+    return logs
+}
+
+// A logger adding the given key value pairs to everything it logs.
+func (l *appLog) with(args ...interface{}) *appLog {
+    return &appLog{handler: slog.New(l.handler).With(args...).Handler(), redact: l.redact}
+}
+
+func (l *appLog) debug(msg string, args ...interface{}) {
+    l.log(slog.LevelDebug, msg, args)
+}
+
+func (l *appLog) info(msg string, args ...interface{}) {
+    l.log(slog.LevelInfo, msg, args)
+}
+
+func (l *appLog) warn(msg string, args ...interface{}) {
+    l.log(slog.LevelWarn, msg, args)
+}
+
+func (l *appLog) error(msg string, args ...interface{}) {
+    l.log(slog.LevelError, msg, args)
+}
+
+func (l *appLog) log(level slog.Level, msg string, args []interface{}) {
+    ctx := context.Background()
+    if !l.handler.Enabled(ctx, level) {
+        return
+    }
+
+    // Skip Callers, log and the level's method, for the line that logged.
+    var pcs [1]uintptr
+    runtime.Callers(3, pcs[:])
+
+    record := slog.NewRecord(time.Now(), level, msg, pcs[0])
+    record.Add(args...)
+    l.handler.Handle(ctx, record)
+}
+
+// A device token as it should be logged: in full, its first few bytes or a
+// hash of it.
+func (l *appLog) token(token []byte) string {
+    switch l.redact {
+    case "truncate":
+        if len(token) > 4 {
+            return hex.EncodeToString(token[:4]) + "..."
+        }
+        return hex.EncodeToString(token)
+    case "hash":
+        sum := sha256.Sum256(token)
+        return "sha256:" + hex.EncodeToString(sum[:8])
+    }
+    return hex.EncodeToString(token)
+}
+
+// A queued push as it should be logged. When redacting, its token goes
+// through token and the alert is left out, anything which isn't json is
+// left out entirely. Only worked out if it is actually logged.
+func (l *appLog) payload(raw string) slog.LogValuer {
+    return loggedPayload{raw: raw, logs: l}
+}
+
+type loggedPayload struct {
+    raw  string
+    logs *appLog
+}
+
+func (p loggedPayload) LogValue() slog.Value {
+    if p.logs.redact == "none" || p.logs.redact == "" {
+        return slog.StringValue(p.raw)
+    }
+
+    jsonIn := make(map[string]interface{})
+    if json.Unmarshal([]byte(p.raw), &jsonIn) != nil {
+        return slog.StringValue("[omitted]")
+    }
+
+    if token, ok := jsonIn["token"].(string); ok {
+        decoded, err := hex.DecodeString(token)
+        if err != nil {
+            jsonIn["token"] = "[omitted]"
+        } else {
+            jsonIn["token"] = p.logs.token(decoded)
+        }
+    }
+    if data, ok := jsonIn["data"].(map[string]interface{}); ok {
+        if aps, ok := data["aps"].(map[string]interface{}); ok {
+            if _, present := aps["alert"]; present {
+                aps["alert"] = "[omitted]"
+            }
+        }
+    }
+
+    out, _ := json.Marshal(jsonIn)
+    return slog.StringValue(string(out))
+}
+
+// Sends debug and info records to one handler, warnings and errors to the
+// other.
+type splitHandler struct {
+    low  slog.Handler
+    high slog.Handler
+}
+
+func newSplitHandler(low, high slog.Handler) *splitHandler {
+    return &splitHandler{low: low, high: high}
+}
+
+func (h *splitHandler) Enabled(ctx context.Context, level slog.Level) bool {
+    if level >= slog.LevelWarn {
+        return h.high.Enabled(ctx, level)
+    }
+    return h.low.Enabled(ctx, level)
+}
+
+func (h *splitHandler) Handle(ctx context.Context, record slog.Record) error {
+    if record.Level >= slog.LevelWarn {
+        return h.high.Handle(ctx, record)
+    }
+    return h.low.Handle(ctx, record)
+}
+
+func (h *splitHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+    return newSplitHandler(h.low.WithAttrs(attrs), h.high.WithAttrs(attrs))
+}
+
+func (h *splitHandler) WithGroup(name string) slog.Handler {
+    return newSplitHandler(h.low.WithGroup(name), h.high.WithGroup(name))
+}
+
+// Gapless' own format, the same lines as ever with any fields on the end:
+//
+//     [Gapless I] [app] 2014/05/13 16:53:20 Sent. identifier=154
+//
+// Errors also say which line logged them.
+type textHandler struct {
+    mu    *sync.Mutex
+    w     io.Writer
+    level slog.Leveler
+    app   string
+    // Fields added through WithAttrs, already formatted.
+    fields string
+    group  string
+}
+
+func newTextHandler(w io.Writer, level slog.Leveler) *textHandler {
+    return &textHandler{mu: &sync.Mutex{}, w: w, level: level}
+}
+
+func (h *textHandler) Enabled(ctx context.Context, level slog.Level) bool {
+    return level >= h.level.Level()
+}
+
+func (h *textHandler) Handle(ctx context.Context, record slog.Record) error {
+    buf := &bytes.Buffer{}
+
+    letter := "I"
+    switch {
+    case record.Level >= slog.LevelError:
+        letter = "E"
+    case record.Level >= slog.LevelWarn:
+        letter = "W"
+    case record.Level < slog.LevelInfo:
+        letter = "D"
+    }
+    fmt.Fprintf(buf, "[Gapless %s] ", letter)
+    if h.app != "" {
+        fmt.Fprintf(buf, "[%s] ", h.app)
+    }
+    buf.WriteString(record.Time.Format("2006/01/02 15:04:05 "))
+
+    if record.Level >= slog.LevelError && record.PC != 0 {
+        frame, _ := runtime.CallersFrames([]uintptr{record.PC}).Next()
+        fmt.Fprintf(buf, "%s:%d: ", filepath.Base(frame.File), frame.Line)
+    }
+
+    buf.WriteString(record.Message)
+    buf.WriteString(h.fields)
+    record.Attrs(func(attr slog.Attr) bool {
+        h.writeAttr(buf, h.group, attr)
+        return true
+    })
+    buf.WriteString("\n")
+
+    h.mu.Lock()
+    defer h.mu.Unlock()
+
+    _, err := h.w.Write(buf.Bytes())
+    return err
+}
+
+// Writes " key=value", quoting the value when it needs it.
+func (h *textHandler) writeAttr(buf *bytes.Buffer, group string, attr slog.Attr) {
+    value := attr.Value.Resolve()
+    if value.Kind() == slog.KindGroup {
+        for _, nested := range value.Group() {
+            h.writeAttr(buf, group+attr.Key+".", nested)
+        }
+        return
+    }
+
+    text := value.String()
+    if text == "" || strings.ContainsAny(text, " =\"\t\n") {
+        text = strconv.Quote(text)
+    }
+    fmt.Fprintf(buf, " %s%s=%s", group, attr.Key, text)
+}
+
+func (h *textHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+    out := *h
+    buf := bytes.NewBufferString(h.fields)
+    for _, attr := range attrs {
+        // The app goes up front, like it always has.
+        if attr.Key == "app" && h.group == "" {
+            out.app = attr.Value.String()
+            continue
+        }
+        h.writeAttr(buf, h.group, attr)
+    }
+    out.fields = buf.String()
+    return &out
+}
+
+func (h *textHandler) WithGroup(name string) slog.Handler {
+    if name == "" {
+        return h
+    }
+    out := *h
+    out.group = h.group + name + "."
+    return &out
+}
@@ -0,0 +1,94 @@
+package gapless
+
+import (
+    "bytes"
+    "context"
+    "encoding/json"
+    "github.com/cojac/assert"
+    "log/slog"
+    "strings"
+    "testing"
+)
+
+func newTestLog(t *testing.T, format, level, redact string) (*appLog, *bytes.Buffer, *bytes.Buffer) {
+    out, errOut := &bytes.Buffer{}, &bytes.Buffer{}
+    handler, err := newLogHandler(format, level, out, errOut)
+    assert.Equal(t, nil, err)
+    return (&appLog{handler: handler, redact: redact}).with("app", "beta"), out, errOut
+}
+
+func TestLogText(t *testing.T) {
+    logs, out, errOut := newTestLog(t, "text", "info", "none")
+
+    logs.debug("Hidden.")
+    logs.with("identifier", 154).info("Sent.", "payload", "{} []")
+    logs.error("Redis ack failed.", "error", "EOF")
+
+    line := out.String()
+    assert.Equal(t, true, strings.HasPrefix(line, "[Gapless I] [beta] "))
+    assert.Equal(t, true, strings.HasSuffix(line, ` Sent. identifier=154 payload="{} []"`+"\n"))
+    assert.Equal(t, false, strings.Contains(line, "Hidden"))
+
+    line = errOut.String()
+    assert.Equal(t, true, strings.HasPrefix(line, "[Gapless E] [beta] "))
+    assert.Equal(t, true, strings.Contains(line, "logging_test.go:"))
+    assert.Equal(t, true, strings.HasSuffix(line, "Redis ack failed. error=EOF\n"))
+}
+
+func TestLogJson(t *testing.T) {
+    logs, out, errOut := newTestLog(t, "json", "debug", "none")
+
+    logs.with("identifier", 154).debug("Sent.", "attempt", 2)
+    logs.warn("Retrying.", "status", uint8(8))
+
+    line := make(map[string]interface{})
+    err := json.Unmarshal(out.Bytes(), &line)
+    assert.Equal(t, nil, err)
+    assert.Equal(t, "DEBUG", line["level"])
+    assert.Equal(t, "Sent.", line["msg"])
+    assert.Equal(t, "beta", line["app"])
+    assert.Equal(t, float64(154), line["identifier"])
+    assert.Equal(t, float64(2), line["attempt"])
+
+    line = make(map[string]interface{})
+    err = json.Unmarshal(errOut.Bytes(), &line)
+    assert.Equal(t, nil, err)
+    assert.Equal(t, float64(8), line["status"])
+
+    _, err = newLogHandler("xml", "info", out, errOut)
+    assert.NotEqual(t, nil, err)
+    _, err = newLogHandler("json", "loud", out, errOut)
+    assert.NotEqual(t, nil, err)
+}
+
+func TestLogRedact(t *testing.T) {
+    token := []byte{0x07, 0x1c, 0x12, 0x8e, 0x01, 0x14}
+    raw := `{"token": "071c128e0114", "identifier": 154, "data": {"aps": {"alert": "You got mail!", "badge": 14}}}`
+
+    logs, _, _ := newTestLog(t, "logfmt", "info", "none")
+    assert.Equal(t, "071c128e0114", logs.token(token))
+    assert.Equal(t, raw, logs.payload(raw).LogValue().String())
+
+    logs, _, _ = newTestLog(t, "logfmt", "info", "truncate")
+    assert.Equal(t, "071c128e...", logs.token(token))
+    assert.Equal(t, `{"data":{"aps":{"alert":"[omitted]","badge":14}},"identifier":154,"token":"071c128e..."}`, logs.payload(raw).LogValue().String())
+    assert.Equal(t, "[omitted]", logs.payload("not json 071c128e0114").LogValue().String())
+
+    logs, out, _ := newTestLog(t, "logfmt", "info", "hash")
+    assert.Equal(t, true, strings.HasPrefix(logs.token(token), "sha256:"))
+    assert.Equal(t, logs.token(token), logs.token(token))
+
+    logs.info("Sent.", "payload", logs.payload(raw))
+    assert.Equal(t, false, strings.Contains(out.String(), "071c128e0114"))
+    assert.Equal(t, false, strings.Contains(out.String(), "mail"))
+}
+
+func TestSplitHandler(t *testing.T) {
+    logs, out, errOut := newTestLog(t, "logfmt", "warn", "none")
+    logs.info("Quiet.")
+    logs.warn("Loud.")
+
+    assert.Equal(t, "", out.String())
+    assert.Equal(t, true, strings.Contains(errOut.String(), "level=WARN"))
+    assert.Equal(t, true, logs.handler.Enabled(context.Background(), slog.LevelError))
+}
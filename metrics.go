@@ -0,0 +1,137 @@
+package gapless
+
+import (
+    "context"
+    "fmt"
+    "github.com/gosexy/redis"
+    "io"
+    "net/http"
+    "sort"
+    "strconv"
+    "sync/atomic"
+    "time"
+)
+
+// A single metric family, written in the Prometheus text format.
+type metricFamily struct {
+    name  string
+    help  string
+    kind  string
+    lines []string
+}
+
+func (m *metricFamily) add(labels string, value interface{}) {
+    m.lines = append(m.lines, fmt.Sprintf("%s{%s} %v", m.name, labels, value))
+}
+
+func (m *metricFamily) addSuffixed(suffix, labels string, value interface{}) {
+    m.lines = append(m.lines, fmt.Sprintf("%s%s{%s} %v", m.name, suffix, labels, value))
+}
+
+func (m *metricFamily) write(w io.Writer) {
+    fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", m.name, m.help, m.name, m.kind)
+    for _, line := range m.lines {
+        fmt.Fprintln(w, line)
+    }
+}
+
+// Writes every app's stats in the Prometheus text exposition format, looking
+// them up with statsOf (statsFor, outside of tests).
+func writeMetrics(w io.Writer, names []string, statsOf func(name string) *serviceStats) {
+    counter := func(name, help string, value func(*serviceStats) int64) *metricFamily {
+        m := &metricFamily{name: name, help: help, kind: "counter"}
+        for _, app := range names {
+            m.add(fmt.Sprintf("app=%q", app), value(statsOf(app)))
+        }
+        return m
+    }
+
+    families := []*metricFamily{
+        counter("gapless_popped_total", "Items popped off the queues.", func(s *serviceStats) int64 { return atomic.LoadInt64(&s.popped) }),
+        counter("gapless_sent_total", "Notifications Apple accepted.", func(s *serviceStats) int64 { return atomic.LoadInt64(&s.sent) }),
+        counter("gapless_retried_total", "Failed sends lined up for a retry.", func(s *serviceStats) int64 { return atomic.LoadInt64(&s.retried) }),
+        counter("gapless_dead_lettered_total", "Notifications handed to the dead letter queue.", func(s *serviceStats) int64 { return atomic.LoadInt64(&s.deadLettered) }),
+        counter("gapless_malformed_total", "Items which couldn't be parsed.", func(s *serviceStats) int64 { return atomic.LoadInt64(&s.malformed) }),
+        counter("gapless_expired_total", "Notifications dropped unsent because they had expired.", func(s *serviceStats) int64 { return atomic.LoadInt64(&s.expired) }),
+        counter("gapless_pool_reconnects_total", "Pooled connections reopened after their first handshake.", func(s *serviceStats) int64 { return atomic.LoadInt64(&s.reconnects) }),
+    }
+
+    failed := &metricFamily{name: "gapless_failed_total", help: "Failed sends by APNs status, 0 when there was none.", kind: "counter"}
+    latency := &metricFamily{name: "gapless_send_duration_seconds", help: "Time taken to hand a notification to Apple, written for the binary protocol and answered for HTTP/2.", kind: "histogram"}
+    pool := &metricFamily{name: "gapless_pool_connections", help: "Pooled connections by state.", kind: "gauge"}
+    depth := &metricFamily{name: "gapless_queue_depth", help: "Items waiting on each queue, as last sampled.", kind: "gauge"}
+
+    for _, app := range names {
+        s := statsOf(app)
+        appLabel := fmt.Sprintf("app=%q", app)
+
+        busy, idle := s.poolUsage()
+        pool.add(appLabel+`,state="busy"`, busy)
+        pool.add(appLabel+`,state="idle"`, idle)
+
+        s.mu.Lock()
+
+        statuses := []int{}
+        for status := range s.failed {
+            statuses = append(statuses, int(status))
+        }
+        sort.Ints(statuses)
+        for _, status := range statuses {
+            failed.add(fmt.Sprintf(`%s,status="%d"`, appLabel, status), s.failed[uint8(status)])
+        }
+
+        cumulative := int64(0)
+        for x, bound := range latencyBuckets {
+            cumulative += s.latencyCounts[x]
+            latency.addSuffixed("_bucket", fmt.Sprintf(`%s,le="%s"`, appLabel, strconv.FormatFloat(bound, 'g', -1, 64)), cumulative)
+        }
+        cumulative += s.latencyCounts[len(latencyBuckets)]
+        latency.addSuffixed("_bucket", appLabel+`,le="+Inf"`, cumulative)
+        latency.addSuffixed("_sum", appLabel, s.latencySum)
+        latency.addSuffixed("_count", appLabel, cumulative)
+
+        keys := []string{}
+        for key := range s.queueDepths {
+            keys = append(keys, key)
+        }
+        sort.Strings(keys)
+        for _, key := range keys {
+            depth.add(fmt.Sprintf("%s,queue=%q", appLabel, key), s.queueDepths[key])
+        }
+
+        s.mu.Unlock()
+    }
+
+    families = append(families, failed, latency, pool, depth)
+    for _, m := range families {
+        m.write(w)
+    }
+}
+
+// Serves the stats of the given apps on /metrics.
+func metricsHandler(names []string, statsOf func(name string) *serviceStats) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+        writeMetrics(w, names, statsOf)
+    })
+}
+
+// Samples the length of every queue until the context is cancelled.
+func sampleQueueDepth(ctx context.Context, client *redis.Client, keys []string, interval time.Duration, stats *serviceStats, logs *appLog) {
+    for {
+        for _, key := range keys {
+            depth, err := client.LLen(key)
+            if err != nil {
+                logs.warn("Sampling a queue length failed.", "queue", key, "error", err)
+                continue
+            }
+            stats.setQueueDepth(key, depth)
+        }
+
+        select {
+        case <-ctx.Done():
+            return
+        case <-time.After(interval):
+        }
+    }
+}
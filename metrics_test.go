@@ -0,0 +1,51 @@
+package gapless
+
+import (
+    "bytes"
+    "github.com/cojac/assert"
+    "strings"
+    "sync/atomic"
+    "testing"
+    "time"
+)
+
+func TestWriteMetrics(t *testing.T) {
+    stats := newServiceStats()
+    atomic.AddInt64(&stats.popped, 3)
+    atomic.AddInt64(&stats.sent, 2)
+    stats.sendFailed(8)
+    stats.sendFailed(8)
+    stats.sendFailed(0)
+    stats.observeLatency(20 * time.Millisecond)
+    stats.observeLatency(time.Minute)
+    stats.setQueueDepth("apns_queue", 7)
+
+    out := &bytes.Buffer{}
+    writeMetrics(out, []string{"metrics-test"}, func(string) *serviceStats { return stats })
+    lines := strings.Split(out.String(), "\n")
+
+    has := func(line string) bool {
+        for _, got := range lines {
+            if got == line {
+                return true
+            }
+        }
+        return false
+    }
+
+    assert.Equal(t, true, has("# TYPE gapless_popped_total counter"))
+    assert.Equal(t, true, has(`gapless_popped_total{app="metrics-test"} 3`))
+    assert.Equal(t, true, has(`gapless_sent_total{app="metrics-test"} 2`))
+    assert.Equal(t, true, has(`gapless_failed_total{app="metrics-test",status="0"} 1`))
+    assert.Equal(t, true, has(`gapless_failed_total{app="metrics-test",status="8"} 2`))
+
+    // Buckets are cumulative.
+    assert.Equal(t, true, has(`gapless_send_duration_seconds_bucket{app="metrics-test",le="0.01"} 0`))
+    assert.Equal(t, true, has(`gapless_send_duration_seconds_bucket{app="metrics-test",le="0.025"} 1`))
+    assert.Equal(t, true, has(`gapless_send_duration_seconds_bucket{app="metrics-test",le="10"} 1`))
+    assert.Equal(t, true, has(`gapless_send_duration_seconds_bucket{app="metrics-test",le="+Inf"} 2`))
+    assert.Equal(t, true, has(`gapless_send_duration_seconds_count{app="metrics-test"} 2`))
+
+    assert.Equal(t, true, has(`gapless_pool_connections{app="metrics-test",state="busy"} 0`))
+    assert.Equal(t, true, has(`gapless_queue_depth{app="metrics-test",queue="apns_queue"} 7`))
+}
@@ -1,44 +1,220 @@
 package gapless
 
-// Setup the connection pool.
-type connectionPoolWrapper struct {
-    size int
-    conn chan *apnsConn
+import (
+    "context"
+    "errors"
+    "fmt"
+    "sync"
+    "sync/atomic"
+    "time"
+)
+
+// The most connections a pool can hold, however it's resized.
+const maxPoolSize = 1000
+
+// Anything which can deliver a notification to Apple.
+// Implemented by apnsConn (binary protocol) and apnsHttp2Conn (HTTP/2 API).
+// The channel returned by SendPayload receives exactly one value, nil once the
+// notification is delivered or the error explaining why it wasn't.
+// Connections are otherwise opened on first use, warmUp opens one up front.
+type apnsTransport interface {
+    SendPayload(token, payload []byte, expiration time.Time, identity uint32, priority uint8) <-chan error
+    warmUp() error
+    shutdown() error
 }
 
-// Holds individual connections to Apple's push servers.
-var connPool = &connectionPoolWrapper{}
+// Setup the connection pool. Holds individual connections to Apple's push
+// servers, one pool per app.
+type connectionPoolWrapper struct {
+    // Held while connections are being put in, taken out or swapped, but not
+    // while new ones are dialed. Sending and reporting never take it.
+    mu sync.Mutex
+    // How many connections the pool holds, busy or not. Only ever touched
+    // through sync/atomic.
+    size int64
+    conn chan apnsTransport
+    log  *appLog
+}
 
 // InitPool populates the connection pool with the correct number of connections.
-func (p *connectionPoolWrapper) InitPool(size int, server, cert, key string) error {
-    p.conn = make(chan *apnsConn, size)
-    for x := 0; x < size; x++ {
-        conn, err := newApnsClient(server, cert, key)
-        if err != nil {
-            return err
-        }
+// The dial function is called once per connection. Each connection is opened
+// straight away, but one which can't be only logs, it is tried again on its
+// first send.
+func (p *connectionPoolWrapper) InitPool(size int, dial func() (apnsTransport, error)) error {
+    if size > maxPoolSize {
+        return errors.New(fmt.Sprintf("A pool can't hold more than %d connections.", maxPoolSize))
+    }
+
+    p.mu.Lock()
+    defer p.mu.Unlock()
 
-        stdout.Printf("Starting apns connection: #%d", x)
+    // Big enough for any size the pool may be resized to.
+    p.conn = make(chan apnsTransport, maxPoolSize)
+    conns, err := p.openConns(0, size, dial)
+    if err != nil {
+        return err
+    }
+    for _, conn := range conns {
         p.conn <- conn
+        atomic.AddInt64(&p.size, 1)
     }
-    p.size = size
     return nil
 }
 
+// Opens count connections, numbered from first. If one can't be dialed the
+// ones opened already are shut down again.
+func (p *connectionPoolWrapper) openConns(first, count int, dial func() (apnsTransport, error)) ([]apnsTransport, error) {
+    conns := []apnsTransport{}
+    for x := 0; x < count; x++ {
+        conn, err := p.open(first+x, dial)
+        if err != nil {
+            for _, conn := range conns {
+                conn.shutdown()
+            }
+            return nil, err
+        }
+        conns = append(conns, conn)
+    }
+    return conns, nil
+}
+
+// Dials connection number x and opens it.
+func (p *connectionPoolWrapper) open(x int, dial func() (apnsTransport, error)) (apnsTransport, error) {
+    conn, err := dial()
+    if err != nil {
+        return nil, err
+    }
+
+    p.log.info("Starting apns connection.", "connection", x)
+    err = conn.warmUp()
+    if err != nil {
+        p.log.warn("Opening apns connection failed.", "connection", x, "error", err)
+    }
+    return conn, nil
+}
+
 // Grab a connection from the pool.
 // If the pool has no available connections, this will block until one becomes available.
-func (p *connectionPoolWrapper) GetConn() *apnsConn {
+func (p *connectionPoolWrapper) GetConn() apnsTransport {
     return <-p.conn
 }
 
+// Like GetConn, but gives up once the context is done.
+func (p *connectionPoolWrapper) GetConnContext(ctx context.Context) (apnsTransport, error) {
+    select {
+    case conn, ok := <-p.conn:
+        if !ok {
+            return nil, errors.New("The connection pool is shut down.")
+        }
+        return conn, nil
+    case <-ctx.Done():
+        return nil, ctx.Err()
+    }
+}
+
+// How many connections the pool holds, busy or not.
+func (p *connectionPoolWrapper) connections() int {
+    return int(atomic.LoadInt64(&p.size))
+}
+
+// How many connections are sitting in the pool, free for use.
+func (p *connectionPoolWrapper) idle() int {
+    return len(p.conn)
+}
+
 // Returns the connection back into the pool for reuse.
-func (p *connectionPoolWrapper) ReleaseConn(conn *apnsConn) {
+func (p *connectionPoolWrapper) ReleaseConn(conn apnsTransport) {
     p.conn <- conn
 }
 
+// Grows or shrinks the pool to the given size. Shrinking waits for
+// connections to be released, until the context is done.
+func (p *connectionPoolWrapper) resize(ctx context.Context, size int, dial func() (apnsTransport, error)) error {
+    if size < 1 || size > maxPoolSize {
+        return errors.New(fmt.Sprintf("A pool holds from 1 to %d connections, not %d.", maxPoolSize, size))
+    }
+
+    // Dial whatever is missing before taking the lock, handshakes take a while.
+    fresh, err := p.openConns(p.connections(), size-p.connections(), dial)
+    if err != nil {
+        return err
+    }
+
+    p.mu.Lock()
+    defer p.mu.Unlock()
+
+    for _, conn := range fresh {
+        // Another resize may have got there first.
+        if p.connections() >= size {
+            conn.shutdown()
+            continue
+        }
+        p.conn <- conn
+        atomic.AddInt64(&p.size, 1)
+    }
+
+    for p.connections() > size {
+        conn, err := p.GetConnContext(ctx)
+        if err != nil {
+            return err
+        }
+        atomic.AddInt64(&p.size, -1)
+        conn.shutdown()
+    }
+    return nil
+}
+
+// Swaps every connection for a freshly dialed one, say to pick up a new
+// certificate. Waits for the connections in use to be released, until the
+// context is done, and leaves the pool as it was if that's first.
+func (p *connectionPoolWrapper) replaceConns(ctx context.Context, dial func() (apnsTransport, error)) error {
+    // Open the new ones first, and before taking the lock, so nothing waits
+    // on the handshakes.
+    fresh, err := p.openConns(0, p.connections(), dial)
+    if err != nil {
+        return err
+    }
+    shutdownFresh := func() {
+        for _, conn := range fresh {
+            conn.shutdown()
+        }
+    }
+
+    p.mu.Lock()
+    defer p.mu.Unlock()
+
+    if len(fresh) != p.connections() {
+        shutdownFresh()
+        return errors.New("The pool was resized while reconnecting, try again.")
+    }
+
+    // Only then take out every old one, so none is swapped twice.
+    old := []apnsTransport{}
+    for range fresh {
+        conn, err := p.GetConnContext(ctx)
+        if err != nil {
+            for _, conn := range old {
+                p.conn <- conn
+            }
+            shutdownFresh()
+            return err
+        }
+        old = append(old, conn)
+    }
+
+    for x, conn := range fresh {
+        p.conn <- conn
+        old[x].shutdown()
+    }
+    return nil
+}
+
 // Gracefully close all the connections.
 func (p *connectionPoolWrapper) ShutdownConns() {
-    for x := 0; x < p.size; x++ {
+    p.mu.Lock()
+    defer p.mu.Unlock()
+
+    for x := 0; x < p.connections(); x++ {
         tmp := <-p.conn
         tmp.shutdown()
     }
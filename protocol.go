@@ -4,7 +4,6 @@ import (
     "bytes"
     "crypto/tls"
     "encoding/binary"
-    "encoding/hex"
     "errors"
     "fmt"
     "io"
@@ -15,15 +14,131 @@ import (
 
 // Connection object which handles the reading/writing and opening/closing of a connection.
 // This file is a modified version from this repo: https://github.com/Mistobaan/go-apns/blob/master/protocol.go
+//
+// Apple only answers the binary protocol when something goes wrong, and then
+// hangs up. So writes never wait for a response, instead a reader goroutine per
+// connection watches for error responses. Recently written frames are kept in
+// a ring buffer, so when Apple rejects identifier N everything written after N
+// (which Apple silently dropped) can be resent on a fresh connection.
 type apnsConn struct {
     tlsconn          *tls.Conn
-    tls_cfg          tls.Config
+    tls_cfg          *tls.Config
     endpoint         string
     ReadTimeout      time.Duration
     mu               sync.Mutex
     transactionId    uint32
     MAX_PAYLOAD_SIZE int
     connected        bool
+    sent             *sentBuffer
+    // Called after every successful handshake, reconnect is false the first time.
+    onConnect        func(reconnect bool)
+    handshakes       int
+    // The app's logger, for what can't be reported through a send.
+    log              *appLog
+}
+
+// A frame which has been written to Apple but may still be rejected.
+type sentFrame struct {
+    id       uint32
+    identity uint32
+    frame    []byte
+    sentAt   time.Time
+    result   chan error
+    resolved bool
+}
+
+// Reports the outcome of the frame. Only the first call has any effect.
+func (f *sentFrame) resolve(err error) {
+    if f.resolved {
+        return
+    }
+    f.resolved = true
+    f.result <- err
+}
+
+// Ring buffer holding the most recently written frames, oldest first.
+type sentBuffer struct {
+    frames []*sentFrame
+    start  int
+    count  int
+}
+
+func newSentBuffer(size int) *sentBuffer {
+    return &sentBuffer{frames: make([]*sentFrame, size)}
+}
+
+func (b *sentBuffer) at(i int) *sentFrame {
+    return b.frames[(b.start+i)%len(b.frames)]
+}
+
+// Adds a frame, pushing out the oldest one when full. A frame which falls out
+// of the buffer can no longer be resent, so it counts as delivered.
+func (b *sentBuffer) add(f *sentFrame) {
+    if b.count == len(b.frames) {
+        b.at(0).resolve(nil)
+        b.frames[b.start] = nil
+        b.start = (b.start + 1) % len(b.frames)
+        b.count--
+    }
+    b.frames[(b.start+b.count)%len(b.frames)] = f
+    b.count++
+}
+
+// Returns the position of the frame with the given transaction id, or -1.
+func (b *sentBuffer) find(id uint32) int {
+    for x := 0; x < b.count; x++ {
+        if b.at(x).id == id {
+            return x
+        }
+    }
+    return -1
+}
+
+// Empties the buffer, returning the frames after position i.
+func (b *sentBuffer) takeAfter(i int) []*sentFrame {
+    after := []*sentFrame{}
+    for x := i + 1; x < b.count; x++ {
+        after = append(after, b.at(x))
+    }
+    b.reset()
+    return after
+}
+
+func (b *sentBuffer) reset() {
+    for x := range b.frames {
+        b.frames[x] = nil
+    }
+    b.start = 0
+    b.count = 0
+}
+
+// Frames nobody complained about for long enough are considered delivered.
+// They stay in the buffer in case a later error means they need resending.
+func (b *sentBuffer) settle(before time.Time) {
+    for x := 0; x < b.count; x++ {
+        f := b.at(x)
+        if f.sentAt.Before(before) {
+            f.resolve(nil)
+        }
+    }
+}
+
+// When the last frame without an outcome was written, false if they all have one.
+func (b *sentBuffer) lastPending() (time.Time, bool) {
+    for x := b.count - 1; x >= 0; x-- {
+        if f := b.at(x); !f.resolved {
+            return f.sentAt, true
+        }
+    }
+    return time.Time{}, false
+}
+
+// Fails every frame which doesn't have an outcome yet and empties the buffer.
+func (b *sentBuffer) fail(err error) {
+    for x := 0; x < b.count; x++ {
+        b.at(x).resolve(err)
+    }
+    b.reset()
 }
 
 func (client *apnsConn) connect() (err error) {
@@ -32,7 +147,7 @@ func (client *apnsConn) connect() (err error) {
     }
 
     if client.tlsconn != nil {
-        client.shutdown()
+        client.disconnect()
     }
 
     conn, err := net.Dial("tcp", client.endpoint)
@@ -41,39 +156,85 @@ func (client *apnsConn) connect() (err error) {
         return err
     }
 
-    client.tlsconn = tls.Client(conn, &client.tls_cfg)
+    client.tlsconn = tls.Client(conn, client.tls_cfg)
 
     err = client.tlsconn.Handshake()
 
     if err == nil {
         client.connected = true
+        go client.readLoop(client.tlsconn)
+
+        client.handshakes++
+        if client.onConnect != nil {
+            client.onConnect(client.handshakes > 1)
+        }
     }
 
     return err
 }
 
-func newApnsClient(endpoint, certificate, key string) (*apnsConn, error) {
-    cert, err := tls.LoadX509KeyPair(certificate, key)
-    if err != nil {
-        return nil, err
+func newApnsClient(endpoint string, tlsCfg *tls.Config) (*apnsConn, error) {
+    if len(tlsCfg.Certificates) == 0 {
+        return nil, errors.New("The binary protocol requires a certificate.")
     }
 
     apnsConn := &apnsConn{
-        tlsconn: nil,
-        tls_cfg: tls.Config{
-            InsecureSkipVerify: true,
-            Certificates:       []tls.Certificate{cert},
-        },
+        tlsconn:          nil,
+        tls_cfg:          tlsCfg.Clone(),
         endpoint:         endpoint,
-        ReadTimeout:      150 * time.Millisecond,
+        ReadTimeout:      time.Second,
         MAX_PAYLOAD_SIZE: 256,
         connected:        false,
+        sent:             newSentBuffer(1000),
+        log:              newAppLog(""),
     }
 
     return apnsConn, nil
 }
 
+// Connects ahead of the first send.
+func (client *apnsConn) warmUp() error {
+    client.mu.Lock()
+    defer client.mu.Unlock()
+
+    return client.connect()
+}
+
+// Closes the connection. Frames written less than ReadTimeout ago may still
+// be rejected, so it first gives Apple that long to complain, otherwise they
+// count as delivered like they would have anyway. Failing them instead would
+// have the caller send them all again. Anything which still has no outcome is
+// failed so the caller can retry it.
 func (client *apnsConn) shutdown() (err error) {
+    client.mu.Lock()
+    defer client.mu.Unlock()
+
+    for client.connected {
+        last, pending := client.sent.lastPending()
+        if !pending {
+            break
+        }
+
+        wait := time.Until(last.Add(client.ReadTimeout))
+        if wait <= 0 {
+            client.sent.settle(time.Now())
+            break
+        }
+
+        // An error response might come in meanwhile, and the frames after it
+        // be resent, the next time round waits for those.
+        client.mu.Unlock()
+        time.Sleep(wait)
+        client.mu.Lock()
+    }
+
+    err = client.disconnect()
+    client.sent.fail(errors.New("Connection shut down before delivery was confirmed"))
+    return
+}
+
+// Must be called with client.mu held.
+func (client *apnsConn) disconnect() (err error) {
     err = nil
     if client.tlsconn != nil {
         err = client.tlsconn.Close()
@@ -92,18 +253,46 @@ func bwrite(w io.Writer, values ...interface{}) (err error) {
     return nil
 }
 
-func createCommandOnePacket(transactionId uint32, expiration time.Duration, token, payload []byte) ([]byte, error) {
-    expirationTime := uint32(time.Now().In(time.UTC).Add(expiration).Unix())
-    buffer := bytes.NewBuffer([]byte{})
+// Item ids used within a command 2 frame.
+const (
+    itemDeviceToken uint8 = 1
+    itemPayload     uint8 = 2
+    itemIdentifier  uint8 = 3
+    itemExpiration  uint8 = 4
+    itemPriority    uint8 = 5
+)
+
+// Builds an enhanced (command 2) notification. The frame is a list of items,
+// each an id, a length and the data. A priority of 0 leaves the item out so
+// Apple falls back to its default of 10 (send immediately), and a zero
+// expiration tells Apple to try once and then discard it.
+func createCommandTwoPacket(transactionId uint32, expiration time.Time, token, payload []byte, priority uint8) ([]byte, error) {
+    expirationTime := uint32(0)
+    if !expiration.IsZero() {
+        expirationTime = uint32(expiration.Unix())
+    }
 
-    err := bwrite(buffer, uint8(1),
-        transactionId,
-        expirationTime,
-        uint16(len(token)),
-        token,
-        uint16(len(payload)),
-        payload)
+    frame := bytes.NewBuffer([]byte{})
 
+    err := bwrite(frame,
+        itemDeviceToken, uint16(len(token)), token,
+        itemPayload, uint16(len(payload)), payload,
+        itemIdentifier, uint16(4), transactionId,
+        itemExpiration, uint16(4), expirationTime)
+    if err != nil {
+        return nil, err
+    }
+
+    if priority != 0 {
+        err = bwrite(frame, itemPriority, uint16(1), priority)
+        if err != nil {
+            return nil, err
+        }
+    }
+
+    buffer := bytes.NewBuffer([]byte{})
+
+    err = bwrite(buffer, uint8(2), uint32(frame.Len()), frame.Bytes())
     if err != nil {
         return nil, err
     }
@@ -113,33 +302,59 @@ func createCommandOnePacket(transactionId uint32, expiration time.Duration, toke
     return pdu, nil
 }
 
-var errText = map[uint8]string{
-    0:   "No errors encountered",
-    1:   "Processing Errors",
-    2:   "Missing Device Token",
-    3:   "Missing Topic",
-    4:   "Missing Payload",
-    5:   "Invalid Token Size",
-    6:   "Invalid Topic Size",
-    7:   "Invalid Payload Size",
-    8:   "Invalid Token",
-    255: "None (Unknown)",
-}
-
 // SendPayload sends push to the device (via Apple of course).
-// The commands waits for a response for no more that client.ReadTimeout.
-// The method uses the same connection. If the connection is closed it tries
-// to reopen it at the next time.
-func (client *apnsConn) SendPayload(token, payload []byte, expiration time.Duration, identity uint32) (err error) {
+// The frame is written straight away and the method returns without waiting
+// for Apple. The returned channel receives exactly one value: the error if
+// Apple rejects the notification, or nil once client.ReadTimeout passes
+// without complaint. If the connection is closed it is reopened first.
+func (client *apnsConn) SendPayload(token, payload []byte, expiration time.Time, identity uint32, priority uint8) <-chan error {
+    result := make(chan error, 1)
+
     if len(payload) > client.MAX_PAYLOAD_SIZE {
-        return errors.New(fmt.Sprintf("The payload exceeds maximum allowed. It was: %d", len(payload)))
+        result <- &APNsError{
+            Status:     7,
+            Identifier: identity,
+            Reason:     fmt.Sprintf("The payload exceeds maximum allowed. It was: %d", len(payload)),
+        }
+        return result
     }
 
     client.mu.Lock()
     defer client.mu.Unlock()
+
+    // Our own transaction id goes on the wire so error responses can be
+    // matched up even when callers reuse identifiers.
+    client.transactionId++
+
+    pkt, err := createCommandTwoPacket(client.transactionId, expiration, token, payload, priority)
+    if err != nil {
+        result <- err
+        return result
+    }
+
+    f := &sentFrame{
+        id:       client.transactionId,
+        identity: identity,
+        frame:    pkt,
+        result:   result,
+    }
+
+    err = client.write(f)
+    if err != nil {
+        f.resolve(err)
+        return result
+    }
+
+    client.sent.add(f)
+    return result
+}
+
+// Writes a single frame, connecting first if needed.
+// Must be called with client.mu held.
+func (client *apnsConn) write(f *sentFrame) (err error) {
     defer func() {
         if err != nil {
-            client.shutdown()
+            client.disconnect()
         }
     }()
 
@@ -149,47 +364,85 @@ func (client *apnsConn) SendPayload(token, payload []byte, expiration time.Durat
         return err
     }
 
-    var pkt []byte
-
-    pkt, err = createCommandOnePacket(identity, expiration, token, payload)
-    if err != nil {
-        return
-    }
+    _, err = client.tlsconn.Write(f.frame)
+    f.sentAt = time.Now()
+    return err
+}
 
-    _, err = client.tlsconn.Write(pkt)
+// Watches a single connection for error responses until it is closed or replaced.
+func (client *apnsConn) readLoop(conn *tls.Conn) {
+    readb := [6]byte{}
 
-    if err != nil {
-        return
-    }
+    for {
+        conn.SetReadDeadline(time.Now().Add(client.ReadTimeout))
+        _, err := io.ReadFull(conn, readb[:])
 
-    client.tlsconn.SetReadDeadline(time.Now().Add(client.ReadTimeout))
+        client.mu.Lock()
 
-    readb := [6]byte{}
+        // We reconnected in the meantime, this connection is no longer ours.
+        if client.tlsconn != conn {
+            client.mu.Unlock()
+            return
+        }
 
-    n, err := client.tlsconn.Read(readb[:])
+        client.sent.settle(time.Now().Add(-client.ReadTimeout))
 
-    if err != nil {
-        if e2, ok := err.(net.Error); ok && e2.Timeout() {
-            err = nil
+        if err != nil {
+            if e2, ok := err.(net.Error); ok && e2.Timeout() {
+                client.mu.Unlock()
+                continue
+            }
+
+            // Apple hung up without telling us why, we can't know what made it.
+            client.disconnect()
+            client.sent.fail(err)
+            client.mu.Unlock()
             return
-        } else {
-            return err
         }
+
+        client.handleErrorResponse(readb)
+        client.mu.Unlock()
+        return
+    }
+}
+
+// Apple closes the connection after every error response, and drops anything
+// we wrote after the failed notification. Fail that one, and resend the rest.
+// Must be called with client.mu held.
+func (client *apnsConn) handleErrorResponse(readb [6]byte) {
+    client.disconnect()
+
+    status := uint8(readb[1])
+    id := binary.BigEndian.Uint32(readb[2:])
+
+    i := client.sent.find(id)
+    if i < 0 {
+        // Too old to resend anything after it, the best we can do is log it.
+        // Whatever is still pending was only dropped, not rejected, so it
+        // fails in a way that gets it retried.
+        client.log.warn("Error response for an unknown transaction.", "transaction", id, "error", newStatusError(status, 0))
+        client.sent.fail(errors.New("Dropped after an error response for an unknown transaction."))
+        return
     }
 
-    if n > 1 {
-        var status uint8 = uint8(readb[1])
+    // Everything up to the failed frame made it through. On shutdown the id
+    // is the last one Apple processed, so that one made it too.
+    for x := 0; x < i; x++ {
+        client.sent.at(x).resolve(nil)
+    }
+    failed := client.sent.at(i)
+    if status == 10 {
+        failed.resolve(nil)
+    } else {
+        failed.resolve(newStatusError(status, failed.identity))
+    }
 
-        switch status {
-        case 0:
-            // pass
-        case 1, 2, 3, 4, 5, 6, 7, 8, 255:
-            return errors.New(errText[status])
-        default:
-            return errors.New(fmt.Sprintf("Unknown error code %s ", hex.EncodeToString(readb[:n])))
+    for _, f := range client.sent.takeAfter(i) {
+        err := client.write(f)
+        if err != nil {
+            f.resolve(err)
+            continue
         }
+        client.sent.add(f)
     }
-
-    err = nil
-    return
 }
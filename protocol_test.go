@@ -0,0 +1,239 @@
+package gapless
+
+import (
+    "encoding/binary"
+    "github.com/cojac/assert"
+    "github.com/cojac/gapless/apnstest"
+    "strings"
+    "testing"
+    "time"
+)
+
+func newTestFrame(id uint32) *sentFrame {
+    return &sentFrame{id: id, identity: id, result: make(chan error, 1), sentAt: time.Now()}
+}
+
+func TestSentBufferEviction(t *testing.T) {
+    buf := newSentBuffer(3)
+    frames := []*sentFrame{}
+    for x := uint32(1); x <= 4; x++ {
+        f := newTestFrame(x)
+        frames = append(frames, f)
+        buf.add(f)
+    }
+
+    // The first frame fell out and counts as delivered.
+    assert.Equal(t, nil, <-frames[0].result)
+    assert.Equal(t, -1, buf.find(1))
+    assert.Equal(t, 0, buf.find(2))
+    assert.Equal(t, 2, buf.find(4))
+}
+
+func TestSentBufferTakeAfter(t *testing.T) {
+    buf := newSentBuffer(5)
+    for x := uint32(1); x <= 5; x++ {
+        buf.add(newTestFrame(x))
+    }
+
+    after := buf.takeAfter(buf.find(3))
+    assert.Equal(t, 2, len(after))
+    assert.Equal(t, uint32(4), after[0].id)
+    assert.Equal(t, uint32(5), after[1].id)
+    assert.Equal(t, 0, buf.count)
+}
+
+func TestSentBufferSettle(t *testing.T) {
+    buf := newSentBuffer(5)
+
+    old := newTestFrame(1)
+    old.sentAt = time.Now().Add(-time.Minute)
+    buf.add(old)
+
+    fresh := newTestFrame(2)
+    buf.add(fresh)
+
+    buf.settle(time.Now().Add(-time.Second))
+    assert.Equal(t, nil, <-old.result)
+    assert.Equal(t, false, fresh.resolved)
+
+    // Resolving twice must not block or change the outcome.
+    old.resolve(nil)
+    assert.Equal(t, 2, buf.count)
+}
+
+func TestCommandTwoPacket(t *testing.T) {
+    token := []byte{0xde, 0xad, 0xbe, 0xef}
+    payload := []byte(`{"aps":{}}`)
+
+    pkt, err := createCommandTwoPacket(77, time.Time{}, token, payload, 5)
+    assert.Equal(t, nil, err)
+
+    assert.Equal(t, uint8(2), pkt[0])
+    assert.Equal(t, uint32(len(pkt)-5), binary.BigEndian.Uint32(pkt[1:5]))
+
+    // Walk the items and collect them by id.
+    items := make(map[uint8][]byte)
+    frame := pkt[5:]
+    for len(frame) > 0 {
+        size := binary.BigEndian.Uint16(frame[1:3])
+        items[frame[0]] = frame[3 : 3+size]
+        frame = frame[3+size:]
+    }
+
+    assert.Equal(t, token, items[itemDeviceToken])
+    assert.Equal(t, payload, items[itemPayload])
+    assert.Equal(t, uint32(77), binary.BigEndian.Uint32(items[itemIdentifier]))
+    assert.Equal(t, uint32(0), binary.BigEndian.Uint32(items[itemExpiration]))
+    assert.Equal(t, []byte{5}, items[itemPriority])
+}
+
+func TestCommandTwoPacketDefaultPriority(t *testing.T) {
+    pkt, err := createCommandTwoPacket(1, time.Now().Add(time.Hour), []byte{1}, []byte("{}"), 0)
+    assert.Equal(t, nil, err)
+
+    // token (3+1) + payload (3+2) + identifier (3+4) + expiration (3+4), no priority.
+    assert.Equal(t, uint32(23), binary.BigEndian.Uint32(pkt[1:5]))
+}
+
+func newTestApnsConn(t *testing.T, s *apnstest.Server) *apnsConn {
+    conn, err := newApnsClient(s.Addr, s.ClientTLSConfig())
+    if err != nil {
+        t.Fatalf("Creating connection failed: %s", err)
+    }
+    conn.ReadTimeout = 50 * time.Millisecond
+    return conn
+}
+
+func TestSendPayloadDelivered(t *testing.T) {
+    s := apnstest.NewServer()
+    defer s.Close()
+
+    conn := newTestApnsConn(t, s)
+    defer conn.shutdown()
+
+    err := <-conn.SendPayload([]byte{1, 2, 3}, []byte(`{"aps":{}}`), time.Now().Add(time.Hour), 42, 10)
+    assert.Equal(t, nil, err)
+
+    received := s.Wait(1, time.Second)
+    assert.Equal(t, 1, len(received))
+    assert.Equal(t, []byte{1, 2, 3}, received[0].Token)
+    assert.Equal(t, uint8(10), received[0].Priority)
+}
+
+func TestSendPayloadRejectedResends(t *testing.T) {
+    s := apnstest.NewServer()
+    defer s.Close()
+
+    // Hold the error back long enough for the third frame to be written too,
+    // so Apple's "drop everything after the error" behaviour kicks in.
+    s.Handle(func(n apnstest.Notification) apnstest.Response {
+        if n.Token[0] == 2 {
+            return apnstest.Response{Status: 8, Delay: 50 * time.Millisecond}
+        }
+        return apnstest.Response{}
+    })
+
+    conn := newTestApnsConn(t, s)
+    conn.ReadTimeout = 250 * time.Millisecond
+    defer conn.shutdown()
+
+    first := conn.SendPayload([]byte{1}, []byte("{}"), time.Now().Add(time.Hour), 1, 0)
+    second := conn.SendPayload([]byte{2}, []byte("{}"), time.Now().Add(time.Hour), 2, 0)
+    third := conn.SendPayload([]byte{3}, []byte("{}"), time.Now().Add(time.Hour), 3, 0)
+
+    assert.Equal(t, nil, <-first)
+    assert.Equal(t, newStatusError(8, 2), <-second)
+    assert.Equal(t, nil, <-third)
+
+    received := s.Wait(2, time.Second)
+    assert.Equal(t, 2, len(received))
+    assert.Equal(t, []byte{3}, received[1].Token)
+    assert.Equal(t, 1, len(s.Rejected()))
+}
+
+func TestSendPayloadTooLarge(t *testing.T) {
+    s := apnstest.NewServer()
+    defer s.Close()
+
+    conn := newTestApnsConn(t, s)
+    defer conn.shutdown()
+
+    err := <-conn.SendPayload([]byte{1}, make([]byte, 300), time.Now().Add(time.Hour), 1, 0)
+    assert.NotEqual(t, nil, err)
+    assert.Equal(t, 0, len(s.Notifications()))
+}
+
+func TestShutdownSettles(t *testing.T) {
+    s := apnstest.NewServer()
+    defer s.Close()
+
+    s.Handle(func(n apnstest.Notification) apnstest.Response {
+        if n.Token[0] == 2 {
+            return apnstest.Response{Status: 8, Delay: 50 * time.Millisecond}
+        }
+        return apnstest.Response{}
+    })
+
+    conn := newTestApnsConn(t, s)
+    conn.ReadTimeout = 250 * time.Millisecond
+
+    // Neither has an outcome yet when the connection is shut down, one is
+    // rejected in the meantime and the other made it.
+    first := conn.SendPayload([]byte{1}, []byte("{}"), time.Now().Add(time.Hour), 1, 0)
+    second := conn.SendPayload([]byte{2}, []byte("{}"), time.Now().Add(time.Hour), 2, 0)
+    conn.shutdown()
+
+    assert.Equal(t, nil, <-first)
+    assert.Equal(t, newStatusError(8, 2), <-second)
+    assert.Equal(t, 1, len(s.Notifications()))
+    assert.Equal(t, 1, len(s.Rejected()))
+}
+
+func TestUnknownTransactionLogsApp(t *testing.T) {
+    s := apnstest.NewServer()
+    defer s.Close()
+
+    conn := newTestApnsConn(t, s)
+    logs, _, errOut := newTestLog(t, "text", "info", "none")
+    conn.log = logs
+
+    // An error for a transaction long gone from the sent buffer.
+    readb := [6]byte{8, 8}
+    binary.BigEndian.PutUint32(readb[2:], 999)
+    conn.mu.Lock()
+    conn.handleErrorResponse(readb)
+    conn.mu.Unlock()
+
+    line := errOut.String()
+    assert.Equal(t, true, strings.HasPrefix(line, "[Gapless W] [beta] "))
+    assert.Equal(t, true, strings.Contains(line, "Error response for an unknown transaction. transaction=999"))
+}
+
+func TestUnknownTransactionRetriesPending(t *testing.T) {
+    s := apnstest.NewServer()
+    defer s.Close()
+
+    conn := newTestApnsConn(t, s)
+    conn.log, _, _ = newTestLog(t, "text", "info", "none")
+
+    pending := []*sentFrame{newTestFrame(5), newTestFrame(6)}
+    conn.mu.Lock()
+    for _, f := range pending {
+        conn.sent.add(f)
+    }
+
+    // Rejects a transaction evicted long ago, the pending ones were only
+    // dropped along with it.
+    readb := [6]byte{8, 8}
+    binary.BigEndian.PutUint32(readb[2:], 1)
+    conn.handleErrorResponse(readb)
+    conn.mu.Unlock()
+
+    for _, f := range pending {
+        err := <-f.result
+        assert.NotEqual(t, nil, err)
+        _, rejected := err.(*APNsError)
+        assert.Equal(t, false, rejected)
+    }
+    assert.Equal(t, 0, conn.sent.count)
+}
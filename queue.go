@@ -0,0 +1,223 @@
+package gapless
+
+import (
+    "context"
+    "errors"
+    "fmt"
+    "os"
+    "sync"
+    "time"
+)
+
+// How long an instance may go quiet before its processing list is recovered.
+const instanceTimeout = 30 * time.Second
+
+// How long (in seconds) a pop blocks waiting for an item, before giving up so
+// we can check whether we're still meant to be listening.
+const popTimeout = 1
+
+// The redis list we consume notifications from.
+//
+// In reliable mode every item is atomically moved onto a processing list owned
+// by this instance (BLMOVE) and only removed once its send is resolved, so
+// nothing is lost if gapless dies mid send. Each instance keeps a heartbeat
+// key alive, and the processing lists of instances whose heartbeat lapsed are
+// pushed back onto the queue.
+//
+// Either way items are taken from the left, so producers RPUSH.
+type redisQueue struct {
+    in       redisClient
+    out      redisClient
+    mu       sync.Mutex
+    key      string
+    reliable bool
+    instance string
+    log      *appLog
+}
+
+func newRedisQueue(in, out redisClient, key string, reliable bool, instance string, logs *appLog) *redisQueue {
+    return &redisQueue{in: in, out: out, key: key, reliable: reliable, instance: instance, log: logs}
+}
+
+// The default instance id, unique per process.
+func defaultInstanceId() string {
+    host, err := os.Hostname()
+    if err != nil {
+        host = "unknown"
+    }
+    return fmt.Sprintf("%s-%d", host, os.Getpid())
+}
+
+func (q *redisQueue) processingKey(instance string) string {
+    return q.key + ":processing:" + instance
+}
+
+func (q *redisQueue) aliveKey(instance string) string {
+    return q.key + ":alive:" + instance
+}
+
+func (q *redisQueue) instancesKey() string {
+    return q.key + ":instances"
+}
+
+// Blocks until an item is available and returns it, or returns "" when none
+// came within the pop timeout.
+func (q *redisQueue) pop() (string, error) {
+    if q.reliable {
+        return q.move("BLMOVE", popTimeout)
+    }
+
+    item, err := q.in.BLPop(popTimeout, "", q.key)
+    if isNilReply(err) {
+        return "", nil
+    }
+    if err != nil {
+        return "", err
+    }
+    if len(item) == 0 {
+        return "", nil
+    }
+    if len(item) < 2 {
+        return "", errors.New(fmt.Sprintf("Unexpected BLPop reply: %v", item))
+    }
+    return item[1], nil
+}
+
+// Takes an item without blocking, returning "" when there is none.
+// Reliable mode only.
+func (q *redisQueue) tryPop() (string, error) {
+    return q.move("LMOVE")
+}
+
+// Moves the item on the left of the queue onto the right of our processing
+// list, which keeps that list oldest first too. The redis client predates
+// LMOVE and BLMOVE, so they go through Command. Returns "" when there was
+// nothing to move.
+func (q *redisQueue) move(command string, timeout ...interface{}) (string, error) {
+    var item string
+    args := append([]interface{}{command, q.key, q.processingKey(q.instance), "LEFT", "RIGHT"}, timeout...)
+    err := q.in.Command(&item, args...)
+    if isNilReply(err) {
+        return "", nil
+    }
+    return item, err
+}
+
+// Puts an item back at the front of the line, so it is the next one popped.
+func (q *redisQueue) requeue(raw string) error {
+    q.mu.Lock()
+    defer q.mu.Unlock()
+
+    _, err := q.out.LPush(q.key, raw)
+    return err
+}
+
+// Returns an item we popped but never dealt with to the front of the line.
+func (q *redisQueue) putBack(raw string) error {
+    err := q.requeue(raw)
+    if err != nil {
+        return err
+    }
+    return q.ack(raw)
+}
+
+// Marks an item as dealt with. Only does something in reliable mode.
+func (q *redisQueue) ack(raw string) error {
+    if !q.reliable {
+        return nil
+    }
+
+    q.mu.Lock()
+    defer q.mu.Unlock()
+
+    _, err := q.out.LRem(q.processingKey(q.instance), 1, raw)
+    return err
+}
+
+// Registers this instance and keeps its heartbeat alive until the context is
+// cancelled, recovering the work of dead instances along the way. Uses its own
+// redis connection.
+func (q *redisQueue) heartbeat(ctx context.Context, client redisClient) {
+    for {
+        _, err := client.SetEx(q.aliveKey(q.instance), int64(instanceTimeout/time.Second), "1")
+        if err == nil {
+            _, err = client.SAdd(q.instancesKey(), q.instance)
+        }
+        if err != nil {
+            q.log.error("Redis heartbeat failed.", "queue", q.key, "error", err)
+        }
+
+        err = q.recover(client)
+        if err != nil {
+            q.log.error("Recovering processing lists failed.", "queue", q.key, "error", err)
+        }
+
+        select {
+        case <-ctx.Done():
+            return
+        case <-time.After(instanceTimeout / 3):
+        }
+    }
+}
+
+// Moves everything left on the processing lists of dead instances back onto
+// the queue. Instances are forgotten once their list is empty.
+func (q *redisQueue) recover(client redisClient) error {
+    instances, err := client.SMembers(q.instancesKey())
+    if err != nil {
+        return err
+    }
+
+    for _, instance := range instances {
+        if instance == q.instance {
+            continue
+        }
+
+        alive, err := client.Exists(q.aliveKey(instance))
+        if err != nil {
+            return err
+        }
+        if alive {
+            continue
+        }
+
+        err = q.recoverInstance(client, instance)
+        if err != nil {
+            return err
+        }
+
+        _, err = client.SRem(q.instancesKey(), instance)
+        if err != nil {
+            return err
+        }
+    }
+
+    return nil
+}
+
+// Moves one instance's processing list back onto the front of the queue, an
+// item at a time so a crash in here can't lose anything either. Taking the
+// newest first leaves them in the order they were popped. Also used at startup
+// for our own list, in case we were restarted with the same instance id.
+func (q *redisQueue) recoverInstance(client redisClient, instance string) error {
+    count, err := client.LLen(q.processingKey(instance))
+    if err != nil {
+        return err
+    }
+
+    for x := int64(0); x < count; x++ {
+        _, err = client.RPopLPush(q.processingKey(instance), q.key)
+        if isNilReply(err) {
+            // Someone else recovered the rest in the meantime.
+            break
+        }
+        if err != nil {
+            return err
+        }
+    }
+
+    if count > 0 {
+        q.log.info("Recovered items from an instance.", "queue", q.key, "instance", instance, "count", count)
+    }
+    return nil
+}
@@ -0,0 +1,81 @@
+package gapless
+
+import (
+    "github.com/cojac/assert"
+    "testing"
+)
+
+func testQueue(client *fakeRedis, reliable bool, instance string) *redisQueue {
+    return newRedisQueue(client, client, "apns_queue", reliable, instance, newAppLog("test"))
+}
+
+func TestQueuePopOrder(t *testing.T) {
+    for _, reliable := range []bool{false, true} {
+        client := newFakeRedis()
+        queue := testQueue(client, reliable, "one")
+        client.RPush(queue.key, "a", "b", "c")
+
+        for _, expected := range []string{"a", "b", "c", ""} {
+            raw, err := queue.pop()
+            assert.Equal(t, nil, err)
+            assert.Equal(t, expected, raw)
+        }
+    }
+}
+
+func TestQueueReliableAck(t *testing.T) {
+    client := newFakeRedis()
+    queue := testQueue(client, true, "one")
+    client.RPush(queue.key, "a", "b", "c")
+
+    queue.pop()
+    queue.tryPop()
+    assert.Equal(t, []string{"a", "b"}, client.list(queue.processingKey("one")))
+    assert.Equal(t, []string{"c"}, client.list(queue.key))
+
+    queue.ack("a")
+    assert.Equal(t, []string{"b"}, client.list(queue.processingKey("one")))
+
+    // Put back at the front of the line, and off the processing list.
+    queue.putBack("b")
+    assert.Equal(t, []string{}, client.list(queue.processingKey("one")))
+    assert.Equal(t, []string{"b", "c"}, client.list(queue.key))
+}
+
+func TestQueueRecover(t *testing.T) {
+    client := newFakeRedis()
+    dead := testQueue(client, true, "dead")
+    client.RPush(dead.key, "a", "b", "c", "d")
+    dead.pop()
+    dead.pop()
+    dead.pop()
+    client.SAdd(dead.instancesKey(), "dead")
+
+    // The dead instance's heartbeat is long gone, what it popped goes back in
+    // front of what it didn't, in the order it was popped.
+    queue := testQueue(client, true, "alive")
+    client.SetEx(queue.aliveKey("alive"), 30, "1")
+    assert.Equal(t, nil, queue.recover(client))
+
+    assert.Equal(t, []string{"a", "b", "c", "d"}, client.list(queue.key))
+    assert.Equal(t, []string{}, client.list(queue.processingKey("dead")))
+    members, _ := client.SMembers(queue.instancesKey())
+    assert.Equal(t, []string{}, members)
+
+    raw, _ := queue.pop()
+    assert.Equal(t, "a", raw)
+}
+
+func TestQueueRecoverSkipsLiveInstances(t *testing.T) {
+    client := newFakeRedis()
+    other := testQueue(client, true, "other")
+    client.RPush(other.key, "a")
+    other.pop()
+    client.SAdd(other.instancesKey(), "other")
+    client.SetEx(other.aliveKey("other"), 30, "1")
+
+    queue := testQueue(client, true, "one")
+    assert.Equal(t, nil, queue.recover(client))
+    assert.Equal(t, []string{"a"}, client.list(queue.processingKey("other")))
+    assert.Equal(t, []string{}, client.list(queue.key))
+}
@@ -0,0 +1,37 @@
+package gapless
+
+import (
+    "github.com/gosexy/redis"
+)
+
+// The redis commands gapless uses, as *redis.Client implements them. Lets the
+// tests swap redis for something in memory.
+type redisClient interface {
+    BLPop(timeout uint64, keys ...string) ([]string, error)
+    LPush(key string, values ...interface{}) (int64, error)
+    RPush(key string, values ...interface{}) (int64, error)
+    LPop(key string) (string, error)
+    LLen(key string) (int64, error)
+    LRem(key string, count int64, value interface{}) (int64, error)
+    RPopLPush(src, dst string) (string, error)
+    Exists(key string) (bool, error)
+    SetEx(key string, seconds int64, value interface{}) (string, error)
+    SAdd(key string, members ...interface{}) (int64, error)
+    SRem(key string, members ...interface{}) (int64, error)
+    SMembers(key string) ([]string, error)
+    ZAdd(key string, args ...interface{}) (int64, error)
+    ZRem(key string, members ...interface{}) (int64, error)
+    Del(keys ...string) (int64, error)
+    Publish(channel string, message interface{}) (int64, error)
+    // Anything the client has no method for, the reply is stored in dest.
+    Command(dest interface{}, values ...interface{}) error
+}
+
+var _ redisClient = &redis.Client{}
+
+// Whether err is the client reporting a nil reply, which is what a blocking pop
+// gets when it times out, and LMOVE or LPOP when the list is empty. Not an
+// error for us, just nothing there.
+func isNilReply(err error) bool {
+    return err == redis.ErrNilReply
+}
@@ -0,0 +1,332 @@
+package gapless
+
+import (
+    "errors"
+    "fmt"
+    "github.com/gosexy/redis"
+    "math"
+    "sort"
+    "strconv"
+    "sync"
+)
+
+// An in memory redis, just enough of one for the tests. Blocking commands
+// don't block, they reply as if they timed out straight away. Nil replies come
+// back as redis.ErrNilReply, like they do from the real client.
+type fakeRedis struct {
+    mu      sync.Mutex
+    lists   map[string][]string
+    sets    map[string]map[string]bool
+    strings map[string]string
+    zsets   map[string]map[string]float64
+    // Everything published, by channel.
+    published map[string][]string
+}
+
+var _ redisClient = newFakeRedis()
+
+func newFakeRedis() *fakeRedis {
+    return &fakeRedis{
+        lists:     make(map[string][]string),
+        sets:      make(map[string]map[string]bool),
+        strings:   make(map[string]string),
+        zsets:     make(map[string]map[string]float64),
+        published: make(map[string][]string),
+    }
+}
+
+// A copy of a list, for checking on it.
+func (r *fakeRedis) list(key string) []string {
+    r.mu.Lock()
+    defer r.mu.Unlock()
+
+    return append([]string{}, r.lists[key]...)
+}
+
+func (r *fakeRedis) BLPop(timeout uint64, keys ...string) ([]string, error) {
+    r.mu.Lock()
+    defer r.mu.Unlock()
+
+    for _, key := range keys {
+        if len(r.lists[key]) > 0 {
+            item := r.lists[key][0]
+            r.lists[key] = r.lists[key][1:]
+            return []string{key, item}, nil
+        }
+    }
+    return nil, redis.ErrNilReply
+}
+
+func (r *fakeRedis) LPush(key string, values ...interface{}) (int64, error) {
+    r.mu.Lock()
+    defer r.mu.Unlock()
+
+    for _, value := range values {
+        r.lists[key] = append([]string{fmt.Sprint(value)}, r.lists[key]...)
+    }
+    return int64(len(r.lists[key])), nil
+}
+
+func (r *fakeRedis) RPush(key string, values ...interface{}) (int64, error) {
+    r.mu.Lock()
+    defer r.mu.Unlock()
+
+    for _, value := range values {
+        r.lists[key] = append(r.lists[key], fmt.Sprint(value))
+    }
+    return int64(len(r.lists[key])), nil
+}
+
+func (r *fakeRedis) LPop(key string) (string, error) {
+    r.mu.Lock()
+    defer r.mu.Unlock()
+
+    list := r.lists[key]
+    if len(list) == 0 {
+        return "", redis.ErrNilReply
+    }
+    r.lists[key] = list[1:]
+    return list[0], nil
+}
+
+func (r *fakeRedis) LLen(key string) (int64, error) {
+    r.mu.Lock()
+    defer r.mu.Unlock()
+
+    return int64(len(r.lists[key])), nil
+}
+
+// Only counts of 0 or more, from the left.
+func (r *fakeRedis) LRem(key string, count int64, value interface{}) (int64, error) {
+    r.mu.Lock()
+    defer r.mu.Unlock()
+
+    kept, removed := []string{}, int64(0)
+    for _, item := range r.lists[key] {
+        if item == fmt.Sprint(value) && (count == 0 || removed < count) {
+            removed++
+            continue
+        }
+        kept = append(kept, item)
+    }
+    r.lists[key] = kept
+    return removed, nil
+}
+
+func (r *fakeRedis) RPopLPush(src, dst string) (string, error) {
+    return r.move(src, dst, "RIGHT", "LEFT")
+}
+
+func (r *fakeRedis) move(src, dst, from, to string) (string, error) {
+    r.mu.Lock()
+    defer r.mu.Unlock()
+
+    list := r.lists[src]
+    if len(list) == 0 {
+        return "", redis.ErrNilReply
+    }
+
+    var item string
+    if from == "LEFT" {
+        item, r.lists[src] = list[0], list[1:]
+    } else {
+        item, r.lists[src] = list[len(list)-1], list[:len(list)-1]
+    }
+    if to == "LEFT" {
+        r.lists[dst] = append([]string{item}, r.lists[dst]...)
+    } else {
+        r.lists[dst] = append(r.lists[dst], item)
+    }
+    return item, nil
+}
+
+func (r *fakeRedis) Exists(key string) (bool, error) {
+    r.mu.Lock()
+    defer r.mu.Unlock()
+
+    _, present := r.strings[key]
+    return present || len(r.lists[key]) > 0 || len(r.sets[key]) > 0 || len(r.zsets[key]) > 0, nil
+}
+
+// Never expires anything.
+func (r *fakeRedis) SetEx(key string, seconds int64, value interface{}) (string, error) {
+    r.mu.Lock()
+    defer r.mu.Unlock()
+
+    r.strings[key] = fmt.Sprint(value)
+    return "OK", nil
+}
+
+func (r *fakeRedis) SAdd(key string, members ...interface{}) (int64, error) {
+    r.mu.Lock()
+    defer r.mu.Unlock()
+
+    if r.sets[key] == nil {
+        r.sets[key] = make(map[string]bool)
+    }
+    added := int64(0)
+    for _, member := range members {
+        if !r.sets[key][fmt.Sprint(member)] {
+            r.sets[key][fmt.Sprint(member)] = true
+            added++
+        }
+    }
+    return added, nil
+}
+
+func (r *fakeRedis) SRem(key string, members ...interface{}) (int64, error) {
+    r.mu.Lock()
+    defer r.mu.Unlock()
+
+    removed := int64(0)
+    for _, member := range members {
+        if r.sets[key][fmt.Sprint(member)] {
+            delete(r.sets[key], fmt.Sprint(member))
+            removed++
+        }
+    }
+    return removed, nil
+}
+
+func (r *fakeRedis) SMembers(key string) ([]string, error) {
+    r.mu.Lock()
+    defer r.mu.Unlock()
+
+    members := []string{}
+    for member := range r.sets[key] {
+        members = append(members, member)
+    }
+    return members, nil
+}
+
+// Takes score member pairs.
+func (r *fakeRedis) ZAdd(key string, args ...interface{}) (int64, error) {
+    r.mu.Lock()
+    defer r.mu.Unlock()
+
+    if r.zsets[key] == nil {
+        r.zsets[key] = make(map[string]float64)
+    }
+    added := int64(0)
+    for x := 0; x+1 < len(args); x += 2 {
+        score, err := strconv.ParseFloat(fmt.Sprint(args[x]), 64)
+        if err != nil {
+            return added, err
+        }
+        member := fmt.Sprint(args[x+1])
+        if _, present := r.zsets[key][member]; !present {
+            added++
+        }
+        r.zsets[key][member] = score
+    }
+    return added, nil
+}
+
+func (r *fakeRedis) ZRem(key string, members ...interface{}) (int64, error) {
+    r.mu.Lock()
+    defer r.mu.Unlock()
+
+    removed := int64(0)
+    for _, member := range members {
+        if _, present := r.zsets[key][fmt.Sprint(member)]; present {
+            delete(r.zsets[key], fmt.Sprint(member))
+            removed++
+        }
+    }
+    return removed, nil
+}
+
+// The members of a sorted set lowest score first, for checking on it.
+func (r *fakeRedis) zset(key string) []string {
+    r.mu.Lock()
+    defer r.mu.Unlock()
+
+    return r.zrange(key, math.Inf(1))
+}
+
+// Members scored up to max, lowest first. Called with r.mu held.
+func (r *fakeRedis) zrange(key string, max float64) []string {
+    members := []string{}
+    for member, score := range r.zsets[key] {
+        if score <= max {
+            members = append(members, member)
+        }
+    }
+    sort.Slice(members, func(i, j int) bool {
+        a, b := r.zsets[key][members[i]], r.zsets[key][members[j]]
+        return a < b || (a == b && members[i] < members[j])
+    })
+    return members
+}
+
+func (r *fakeRedis) Del(keys ...string) (int64, error) {
+    r.mu.Lock()
+    defer r.mu.Unlock()
+
+    removed := int64(0)
+    for _, key := range keys {
+        _, present := r.strings[key]
+        if present || r.lists[key] != nil || r.sets[key] != nil || r.zsets[key] != nil {
+            removed++
+        }
+        delete(r.strings, key)
+        delete(r.lists, key)
+        delete(r.sets, key)
+        delete(r.zsets, key)
+    }
+    return removed, nil
+}
+
+// Nobody is ever subscribed.
+func (r *fakeRedis) Publish(channel string, message interface{}) (int64, error) {
+    r.mu.Lock()
+    defer r.mu.Unlock()
+
+    r.published[channel] = append(r.published[channel], fmt.Sprint(message))
+    return 0, nil
+}
+
+// Knows LMOVE, BLMOVE and EVAL of promoteScript.
+func (r *fakeRedis) Command(dest interface{}, values ...interface{}) error {
+    args := make([]string, len(values))
+    for x, value := range values {
+        args[x] = fmt.Sprint(value)
+    }
+
+    switch args[0] {
+    case "LMOVE", "BLMOVE":
+        item, err := r.move(args[1], args[2], args[3], args[4])
+        *dest.(*string) = item
+        return err
+    case "EVAL":
+        if args[1] == promoteScript {
+            return r.promote(dest.(*[]string), args[3], args[4], args[5], args[6])
+        }
+    }
+    return errors.New("fakeRedis: unknown command " + args[0])
+}
+
+func (r *fakeRedis) promote(dest *[]string, set, list, now, limit string) error {
+    r.mu.Lock()
+    defer r.mu.Unlock()
+
+    max, err := strconv.ParseFloat(now, 64)
+    if err != nil {
+        return err
+    }
+    count, err := strconv.Atoi(limit)
+    if err != nil {
+        return err
+    }
+
+    due := r.zrange(set, max)
+    if len(due) > count {
+        due = due[:count]
+    }
+    for _, raw := range due {
+        delete(r.zsets[set], raw)
+        r.lists[list] = append([]string{raw}, r.lists[list]...)
+    }
+    *dest = due
+    return nil
+}
@@ -0,0 +1,35 @@
+package gapless
+
+import (
+    "math"
+    "math/rand"
+    "time"
+)
+
+// Decides how many times, and how far apart, a failed notification is retried.
+type retryPolicy struct {
+    // Total number of sends, the first one included.
+    maxAttempts int
+    baseDelay   time.Duration
+    multiplier  float64
+    // Fraction of the delay to randomly add or take away, so retries from an
+    // outage don't all come back at once.
+    jitter   float64
+    maxDelay time.Duration
+}
+
+// Returns how long to wait before the given retry (1 for the first retry).
+func (p retryPolicy) delay(retry int) time.Duration {
+    delay := float64(p.baseDelay) * math.Pow(p.multiplier, float64(retry-1))
+    if p.maxDelay > 0 && delay > float64(p.maxDelay) {
+        delay = float64(p.maxDelay)
+    }
+
+    if p.jitter > 0 {
+        delay += delay * p.jitter * (2*rand.Float64() - 1)
+    }
+    if delay < 0 {
+        delay = 0
+    }
+    return time.Duration(delay)
+}
@@ -0,0 +1,37 @@
+package gapless
+
+import (
+    "github.com/cojac/assert"
+    "testing"
+    "time"
+)
+
+func TestRetryPolicyDelay(t *testing.T) {
+    policy := retryPolicy{
+        maxAttempts: 4,
+        baseDelay:   time.Second,
+        multiplier:  2,
+        maxDelay:    5 * time.Second,
+    }
+
+    assert.Equal(t, time.Second, policy.delay(1))
+    assert.Equal(t, 2*time.Second, policy.delay(2))
+    assert.Equal(t, 4*time.Second, policy.delay(3))
+    assert.Equal(t, 5*time.Second, policy.delay(4))
+}
+
+func TestRetryPolicyJitter(t *testing.T) {
+    policy := retryPolicy{baseDelay: 10 * time.Second, multiplier: 1, jitter: 0.5}
+
+    for x := 0; x < 100; x++ {
+        delay := policy.delay(1)
+        if delay < 5*time.Second || delay > 15*time.Second {
+            t.Errorf("Delay out of range: %s", delay)
+        }
+    }
+}
+
+func TestRetryPolicyImmediate(t *testing.T) {
+    policy := retryPolicy{multiplier: 2, jitter: 0.2}
+    assert.Equal(t, time.Duration(0), policy.delay(3))
+}
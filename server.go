@@ -0,0 +1,174 @@
+package gapless
+
+import (
+    "context"
+    "errors"
+    "fmt"
+    "net"
+    "net/http"
+    "sort"
+    "sync"
+)
+
+// Server runs gapless: a pipeline per app, from popping its redis queues
+// through to delivering to Apple. Create one with New.
+type Server struct {
+    cfg *DictObj
+    // App settings by name, just the one named "" without an 'apps' section.
+    apps map[string]*DictObj
+    // And their runtime controls, for the admin API.
+    controls map[string]*appControl
+    // Sources given with UseSource, by app.
+    sources map[string]Source
+}
+
+// New prepares a server for the given settings. Nothing is connected until Run.
+//
+// With an 'apps' section in the settings, every app in it gets a pipeline of
+// its own (connections, queues and all), each running on the top level
+// settings overlaid with the app's.
+//
+// Logging is left as it is, see ConfigureLogging.
+func New(cfg *DictObj) (*Server, error) {
+    s := &Server{cfg: cfg, apps: make(map[string]*DictObj), controls: make(map[string]*appControl), sources: make(map[string]Source)}
+
+    apps, err := cfg.Map("apps")
+    if err != nil {
+        return nil, err
+    }
+    if apps == nil {
+        s.apps[""] = cfg
+        s.controls[""] = newAppControl()
+        return s, nil
+    }
+
+    for name := range apps {
+        settings, err := AppSettings(cfg, name)
+        if err != nil {
+            return nil, err
+        }
+        s.apps[name] = settings
+        s.controls[name] = newAppControl()
+    }
+    if len(s.apps) == 0 {
+        return nil, errors.New("The 'apps' section doesn't list any apps.")
+    }
+    return s, nil
+}
+
+// UseSource has an app take its notifications from source rather than from
+// its redis lists. The app is named as in the 'apps' section, or "" without
+// one. Call it before Run.
+func (s *Server) UseSource(app string, source Source) error {
+    if _, present := s.apps[app]; !present {
+        return errors.New(fmt.Sprintf("Unknown app: %s", app))
+    }
+    s.sources[app] = source
+    return nil
+}
+
+// Run listens to our redis queues until the context is cancelled, returning
+// nil once everything has stopped. If any app fails, the others are stopped
+// too and its error returned.
+func (s *Server) Run(ctx context.Context) error {
+    ctx, cancel := context.WithCancel(ctx)
+    defer cancel()
+
+    names := []string{}
+    for name := range s.apps {
+        names = append(names, name)
+    }
+    sort.Strings(names)
+
+    // Our HTTP endpoints, if asked for.
+    if addr := s.cfg.String("http_listen", ""); addr != "" {
+        ownSource := make(map[string]bool)
+        for name := range s.sources {
+            ownSource[name] = true
+        }
+
+        mux := http.NewServeMux()
+        mux.Handle("/metrics", metricsHandler(names, statsFor))
+        mux.Handle("/healthz", healthHandler(s.apps, statsFor, ownSource, false))
+        mux.Handle("/readyz", healthHandler(s.apps, statsFor, ownSource, true))
+
+        httpServer, err := serveHTTP(addr, mux)
+        if err != nil {
+            return err
+        }
+        defer httpServer.Close()
+    }
+
+    // The admin API gets an address of its own, so it needn't be reachable
+    // from wherever the metrics are scraped.
+    if addr := s.cfg.String("admin_listen", ""); addr != "" {
+        token, err := secretSetting(s.cfg, "admin_token")
+        if err != nil {
+            return errors.New(fmt.Sprintf("Reading the admin token failed: %s.", err))
+        }
+        if token == "" {
+            return errors.New("The admin API needs a token, see 'admin_token_env' and 'admin_token_file'.")
+        }
+
+        adminServer, err := serveHTTP(addr, adminHandler(s, token))
+        if err != nil {
+            return err
+        }
+        defer adminServer.Close()
+    }
+
+    var wg sync.WaitGroup
+    errs := make(chan error, len(names))
+    for _, name := range names {
+        wg.Add(1)
+        go func(name string, settings *DictObj) {
+            defer wg.Done()
+
+            err := runApp(ctx, name, settings, s.controls[name], s.sources[name])
+            if err != nil {
+                if name != "" {
+                    err = errors.New(fmt.Sprintf("App %s: %s", name, err))
+                }
+                errs <- err
+                cancel()
+            }
+        }(name, s.apps[name])
+    }
+    wg.Wait()
+
+    close(errs)
+    return <-errs
+}
+
+// Serves handler on addr in the background. Only the listening happens up
+// front, so that failing to is an error.
+func serveHTTP(addr string, handler http.Handler) (*http.Server, error) {
+    listener, err := net.Listen("tcp", addr)
+    if err != nil {
+        return nil, errors.New(fmt.Sprintf("Listening on %s failed: %s.", addr, err))
+    }
+
+    httpServer := &http.Server{Handler: handler}
+    go httpServer.Serve(listener)
+    return httpServer, nil
+}
+
+// AppSettings returns the settings an app in the 'apps' section runs with,
+// the top level settings overlaid with its own.
+func AppSettings(cfg *DictObj, name string) (*DictObj, error) {
+    apps, err := cfg.Map("apps")
+    if err != nil {
+        return nil, err
+    }
+
+    result, present := apps[name]
+    if !present {
+        return nil, errors.New(fmt.Sprintf("Unknown app: %s", name))
+    }
+
+    appSettings, ok := result.(map[string]interface{})
+    if !ok {
+        return nil, errors.New(fmt.Sprintf("The settings for app %q must be a dict.", name))
+    }
+    return cfg.Overlay(appSettings), nil
+}
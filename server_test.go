@@ -0,0 +1,77 @@
+package gapless
+
+import (
+    "context"
+    "github.com/cojac/assert"
+    "strings"
+    "testing"
+)
+
+func TestAppSettings(t *testing.T) {
+    cfg := NewSettingsObj()
+    cfg.Set("pool_size", float64(2))
+    cfg.Set("apps", map[string]interface{}{
+        "beta": map[string]interface{}{"pool_size": float64(5), "redis_queue_key": "beta_queue"},
+        "bad":  "not a dict",
+    })
+
+    settings, err := AppSettings(cfg, "beta")
+    assert.Equal(t, nil, err)
+    assert.Equal(t, 5, settings.Int("pool_size"))
+    assert.Equal(t, "beta_queue", settings.String("redis_queue_key"))
+
+    _, err = AppSettings(cfg, "bad")
+    assert.NotEqual(t, nil, err)
+
+    _, err = AppSettings(cfg, "prod")
+    assert.NotEqual(t, nil, err)
+}
+
+func TestServerNew(t *testing.T) {
+    cfg := NewSettingsObj()
+    server, err := New(cfg)
+    assert.Equal(t, nil, err)
+    assert.Equal(t, 1, len(server.apps))
+
+    cfg.Set("apps", map[string]interface{}{
+        "beta": map[string]interface{}{},
+        "prod": map[string]interface{}{},
+    })
+    server, err = New(cfg)
+    assert.Equal(t, nil, err)
+    assert.Equal(t, 2, len(server.apps))
+
+    cfg.Set("apps", map[string]interface{}{"beta": "not a dict"})
+    _, err = New(cfg)
+    assert.NotEqual(t, nil, err)
+
+    cfg.Set("apps", []interface{}{"beta"})
+    _, err = New(cfg)
+    assert.NotEqual(t, nil, err)
+    _, err = AppSettings(cfg, "beta")
+    assert.NotEqual(t, nil, err)
+}
+
+func TestServerNewLeavesLogging(t *testing.T) {
+    // Only ConfigureLogging minds the logging settings.
+    cfg := NewSettingsObj()
+    cfg.Set("log_level", "loud")
+    _, err := New(cfg)
+    assert.Equal(t, nil, err)
+    assert.NotEqual(t, nil, ConfigureLogging(cfg))
+}
+
+func TestServerRunError(t *testing.T) {
+    cfg := NewSettingsObj()
+    cfg.Set("apps", map[string]interface{}{
+        "beta": map[string]interface{}{"apns_server": "127.0.0.1:2195", "apns_transport": "carrier pigeon"},
+    })
+
+    server, err := New(cfg)
+    assert.Equal(t, nil, err)
+
+    // A broken app comes back as an error, rather than taking the process down.
+    err = server.Run(context.Background())
+    assert.NotEqual(t, nil, err)
+    assert.Equal(t, true, strings.HasPrefix(err.Error(), "App beta: Unknown 'apns_transport'"))
+}
@@ -2,165 +2,695 @@
 package gapless
 
 import (
+    "context"
+    "crypto/tls"
     "encoding/hex"
     "encoding/json"
     "errors"
     "fmt"
     "github.com/gosexy/redis"
-    "log"
     // "net/http"
     // _ "net/http/pprof"
     "os"
     "path/filepath"
+    "strings"
+    "sync"
+    "sync/atomic"
+    "syscall"
     "time"
 )
 
 // Global settings which are loaded from a json file passed via cmd line.
 var Settings = NewSettingsObj()
 
-var stdout = log.New(os.Stdout, "[Gapless I] ", log.Ldate|log.Ltime)
-var stderr = log.New(os.Stderr, "[Gapless E] ", log.Ldate|log.Ltime|log.Lshortfile)
-
 type gapObj struct {
     token      []byte
     identifier uint32
     expiry     time.Duration
+    priority   uint8
+    sendAt     time.Time
+    expiresAt  time.Time
     jData      []byte
 }
 
-// Main run function. This will listen to our redis connection indefinitely.
-// If redis were to crash, this application will panic and exit.
-func Run() {
-    // go func() {
-    //     log.Println(http.ListenAndServe("localhost:8000", nil))
-    // }()
+// Runs a single app's pipeline until the context is cancelled. Items already
+// popped get until the 'shutdown_timeout' to finish, whatever hasn't by then
+// goes back on its queue. Nothing new is popped while control is paused.
+//
+// Notifications come from the app's redis lists, unless source is given.
+func runApp(ctx context.Context, name string, settings *DictObj, control *appControl, source Source) error {
+    logs := newAppLog(name)
+    stats := statsFor(name)
+
+    // Our background work stops along with us, before the redis connections
+    // it uses are closed.
+    ctx, cancel := context.WithCancel(ctx)
+    var background sync.WaitGroup
+    var clients []*redis.Client
+    defer func() {
+        cancel()
+        background.Wait()
+        for _, client := range clients {
+            client.Quit()
+        }
+    }()
 
-    // Prep our certificate file paths.
-    apnsCert := Settings.String("apns_cert_path")
-    if !filepath.IsAbs(apnsCert) {
-        apnsCert = filepath.Dir(Settings.ConfFile) + "/" + apnsCert
+    // Opens a redis connection, closed again on the way out.
+    redisConn := func() (*redis.Client, error) {
+        client, err := newRedisConn(settings)
+        if err == nil {
+            clients = append(clients, client)
+        }
+        return client, err
+    }
+
+    // Runs a background task until we stop.
+    goBackground := func(task func()) {
+        background.Add(1)
+        go func() {
+            defer background.Done()
+            task()
+        }()
+    }
+
+    dialer, err := newApnsDialer(settings, logs, stats)
+    if err != nil {
+        return err
     }
-    apnsKey := Settings.String("apns_key_path")
-    if !filepath.IsAbs(apnsKey) {
-        apnsKey = filepath.Dir(Settings.ConfFile) + "/" + apnsKey
+
+    // Initialize the pool of APNS connections, less any kept back for the
+    // highest priority queue.
+    poolSize := settings.Int("pool_size", 2)
+    reserved := settings.Int("reserved_connections", 0)
+    if reserved < 0 || reserved >= poolSize {
+        return errors.New(fmt.Sprintf("The 'reserved_connections' (%d) must leave at least one of the 'pool_size' (%d) connections unreserved.", reserved, poolSize))
     }
 
-    // Initialize the pool of APNS connections.
-    err := connPool.InitPool(Settings.Int("pool_size", 2), Settings.String("apns_server"), apnsCert, apnsKey)
+    connPool := &connectionPoolWrapper{log: logs}
+    err = connPool.InitPool(poolSize-reserved, dialer.dial)
     if err != nil {
-        stderr.Fatalf("Connection pool failed to initialize: %s.", err)
+        return errors.New(fmt.Sprintf("Connection pool failed to initialize: %s.", err))
     }
 
     // Clean up our connection pool when exiting.
     defer connPool.ShutdownConns()
 
-    // Init our redis connections.
-    inClient := newRedisConn()
-    outClient := newRedisConn()
+    var reservedPool *connectionPoolWrapper
+    if reserved > 0 {
+        reservedPool = &connectionPoolWrapper{log: logs}
+        err = reservedPool.InitPool(reserved, dialer.dial)
+        if err != nil {
+            return errors.New(fmt.Sprintf("Reserved connection pool failed to initialize: %s.", err))
+        }
+        defer reservedPool.ShutdownConns()
+    }
+    stats.setPools(connPool, reservedPool)
 
-    // Again, clean up our connection when exiting.
-    defer inClient.Quit()
-    defer outClient.Quit()
+    // Poll the feedback service for dead tokens, if asked to.
+    if feedbackServer := settings.String("feedback_server", ""); feedbackServer != "" {
+        if len(dialer.certs) == 0 {
+            return errors.New("The feedback service requires a certificate, see 'apns_cert_path'.")
+        }
 
-    // The redis queue key to be used.
-    queueKey := Settings.String("redis_queue_key", "")
-    if queueKey == "" {
-        stderr.Fatalf("The 'redis_queue_key' must be defined in your settings.")
+        feedbackCfg, err := newApnsTlsConfig(feedbackServer, dialer.certs, dialer.tlsOpts)
+        if err != nil {
+            return errors.New(fmt.Sprintf("Preparing the feedback TLS config failed: %s.", err))
+        }
+
+        sink := &tokenSink{
+            key:     settings.String("feedback_redis_key", ""),
+            keyType: settings.String("feedback_redis_type", "set"),
+        }
+        if sink.key == "" {
+            return errors.New("The 'feedback_redis_key' must be defined when 'feedback_server' is.")
+        }
+        if !validSinkType(sink.keyType) {
+            return errors.New(fmt.Sprintf("Unknown 'feedback_redis_type' (%s), expected 'set', 'list' or 'publish'.", sink.keyType))
+        }
+
+        sink.client, err = redisConn()
+        if err != nil {
+            return err
+        }
+
+        interval := time.Duration(settings.Int("feedback_interval", 3600)) * time.Second
+        goBackground(func() { runFeedback(ctx, feedbackServer, feedbackCfg, interval, sink, logs) })
     }
 
-    logSuccesses := Settings.Bool("log_successes", false)
+    // Where tokens Apple rejects as invalid are sent, if anywhere.
+    var invalidTokens *tokenSink
+    if key := settings.String("invalid_token_redis_key", ""); key != "" {
+        invalidTokens = &tokenSink{
+            key:     key,
+            keyType: settings.String("invalid_token_redis_type", "set"),
+        }
+        if !validSinkType(invalidTokens.keyType) {
+            return errors.New(fmt.Sprintf("Unknown 'invalid_token_redis_type' (%s), expected 'set', 'list' or 'publish'.", invalidTokens.keyType))
+        }
 
-    // Energizer loop.
-    for {
-        // List to our redis list, one item at a time.
-        item, err := inClient.BLPop(0, "", queueKey)
+        invalidTokens.client, err = redisConn()
         if err != nil {
-            stderr.Fatalf("Redis BLPop failed: %s. (%v)", err, item)
+            return err
         }
+    }
 
-        // Grab the string out.
-        raw := item[1]
+    // Where the notifications come from, and for the reserved connections
+    // just those of the highest priority. A source of the embedder's own has
+    // no priorities to reserve connections for.
+    var reservedSource Source
+    fromRedis := source == nil
+    if fromRedis {
+        redisSource, redisReserved, err := newRedisSources(ctx, settings, logs, redisConn, goBackground, reservedPool != nil)
+        if err != nil {
+            return err
+        }
+        source = redisSource
+        if redisReserved != nil {
+            reservedSource = redisReserved
+        }
+    } else if reservedPool != nil {
+        return errors.New("The 'reserved_connections' only work with the redis queues, not with a source of your own.")
+    }
 
-        // We grab a connection from the pool.
-        // This call will block until a connection is available again.
-        // If your still getting back logged, increase your pool size.
-        conn := connPool.GetConn()
+    // Whether the source still works is part of being ready.
+    source = &watchedSource{Source: source, stats: stats}
+    if reservedSource != nil {
+        reservedSource = &watchedSource{Source: reservedSource, stats: stats}
+    }
 
-        // Process the string in a goroutine.
-        go func(input string, apns *apnsConn) {
-            // Ensure to return the connection back to the pool when done here.
-            defer connPool.ReleaseConn(apns)
+    // Failed pushes wait in a sorted set until they are due again.
+    retries := retryPolicy{
+        maxAttempts: settings.Int("retry_max_attempts", 4),
+        baseDelay:   time.Duration(settings.Float("retry_base_delay", 1) * float64(time.Second)),
+        multiplier:  settings.Float("retry_multiplier", 2),
+        jitter:      settings.Float("retry_jitter", 0.2),
+        maxDelay:    time.Duration(settings.Float("retry_max_delay", 300) * float64(time.Second)),
+    }
 
-            jsonIn := make(map[string]interface{})
-            err := json.Unmarshal([]byte(input), &jsonIn)
-            if err != nil {
-                // If an error occurs while reading the json, ignore this item and continue on.
-                stderr.Printf("Json unmarshal error (%s): %s.", input, err)
+    // Keep an eye on how far behind we are and whether redis is still
+    // there, for the HTTP endpoints. Not for a source of the embedder's own,
+    // which needn't have any queues in redis.
+    if fromRedis && settings.String("http_listen", "") != "" {
+        queueKeyList, _, err := queueKeys(settings)
+        if err != nil {
+            return err
+        }
+        depthClient, err := redisConn()
+        if err != nil {
+            return err
+        }
+
+        interval := time.Duration(settings.Float("queue_depth_interval", 15) * float64(time.Second))
+        goBackground(func() { sampleQueueDepth(ctx, depthClient, queueKeyList, interval, stats, logs) })
+
+        healthClient, err := redisConn()
+        if err != nil {
+            return err
+        }
+
+        interval = time.Duration(settings.Float("health_interval", 5) * float64(time.Second))
+        goBackground(func() { checkRedis(ctx, healthClient, interval, stats) })
+    }
+
+    // Where notifications we gave up on end up, if anywhere.
+    var deadLetters *deadLetterQueue
+    if key := settings.String("dead_letter_key", ""); key != "" {
+        deadLetters = &deadLetterQueue{key: key}
+        deadLetters.client, err = redisConn()
+        if err != nil {
+            return err
+        }
+    }
+
+    // Hands a notification we gave up on to the dead letter queue.
+    giveUp := func(msg *Message, reason error, attempts int, jsonIn map[string]interface{}) {
+        if deadLetters == nil {
+            return
+        }
+
+        letter := deadLetter{
+            Payload:  msg.Body,
+            Queue:    msg.Queue,
+            Error:    reason.Error(),
+            Attempts: attempts,
+            FailedAt: time.Now().Unix(),
+        }
+        if first, ok := jsonIn["_gapless_FIRST_FAILED"].(float64); ok {
+            letter.FirstFailedAt = int64(first)
+        }
+
+        err := deadLetters.push(letter)
+        if err != nil {
+            logs.error("Dead letter push failed.", "queue", msg.Queue, "payload", logs.payload(msg.Body), "error", err)
+            return
+        }
+        atomic.AddInt64(&stats.deadLettered, 1)
+    }
+
+    // Successes are only logged at the info level if asked for.
+    logSuccesses := settings.Bool("log_successes", false)
+    logSuccess := func(msg string, logs *appLog, args ...interface{}) {
+        if logSuccesses {
+            logs.info(msg, args...)
+        } else {
+            logs.debug(msg, args...)
+        }
+    }
+
+    // Popped items, until they are dealt with.
+    inFlight := newInFlightSet()
+
+    // Hand the admin API what it needs, and take it back before the pools
+    // are shut down.
+    control.attach(&appRuntime{
+        settings:     settings,
+        logs:         logs,
+        stats:        stats,
+        dialer:       dialer,
+        pool:         connPool,
+        reservedPool: reservedPool,
+        inFlight:     inFlight,
+    })
+    defer control.attach(nil)
+
+    // Sends a single popped item, releasing its connection back to the pool
+    // as soon as it's been written.
+    process := func(item *inFlightItem, pool *connectionPoolWrapper, apns apnsTransport) {
+        source, msg, input := item.source, item.msg, item.msg.Body
+        itemLogs := logs.with("queue", msg.Queue)
+
+        // Nothing is done about the outcome if shutdown took the item back
+        // in the meantime, it's already on its queue again.
+        owned := false
+        claim := func() bool {
+            owned = inFlight.claim(item)
+            return owned
+        }
+
+        // However this ends, the item is done with once we return. Unless
+        // putting it back for a retry failed, then the source has the only copy.
+        requeueFailed := false
+        defer func() {
+            defer inFlight.done(item)
+            if requeueFailed || !owned {
+                return
+            }
+            endErr := source.Ack(msg)
+            if endErr != nil {
+                itemLogs.error("Ack failed.", "payload", itemLogs.payload(input), "error", endErr)
+            }
+        }()
+
+        jsonIn := make(map[string]interface{})
+        err := json.Unmarshal([]byte(input), &jsonIn)
+        if err != nil {
+            pool.ReleaseConn(apns)
+
+            // If an error occurs while reading the json, ignore this item and continue on.
+            atomic.AddInt64(&stats.malformed, 1)
+            itemLogs.error("Json unmarshal error.", "payload", itemLogs.payload(input), "error", err)
+            if claim() {
+                giveUp(msg, err, 0, jsonIn)
+            }
+            return
+        }
+
+        // Stamp when we first saw it, if the source app didn't, so retries
+        // measure the relative expiry from here rather than from the retry.
+        if _, present := jsonIn["enqueued_at"]; !present {
+            jsonIn["enqueued_at"] = float64(time.Now().Unix())
+        }
+
+        gapOut, err := parseApnsJson(jsonIn)
+        if err != nil {
+            pool.ReleaseConn(apns)
+
+            // If an error occurs while reading the json, ignore this item and continue on.
+            atomic.AddInt64(&stats.malformed, 1)
+            itemLogs.error("Parsing apns structure error.", "payload", itemLogs.payload(input), "error", err)
+            if claim() {
+                giveUp(msg, err, 0, jsonIn)
+            }
+            return
+        }
+
+        itemLogs = itemLogs.with("identifier", gapOut.identifier)
+
+        // Not due yet, park it until it is.
+        if gapOut.sendAt.After(time.Now()) {
+            pool.ReleaseConn(apns)
+            if !claim() {
                 return
             }
 
-            gapOut, err := parseApnsJson(jsonIn)
+            err = source.Schedule(msg, gapOut.sendAt, gapOut.identifier)
             if err != nil {
-                // If an error occurs while reading the json, ignore this item and continue on.
-                stderr.Printf("Parsing apns structure error (%q): %s.", jsonIn, err)
+                itemLogs.error("Scheduling failed.", "payload", itemLogs.payload(input), "error", err)
+                requeueFailed = true
                 return
             }
 
-            // Send the payload out.
-            err = apns.SendPayload(gapOut.token, gapOut.jData, gapOut.expiry, gapOut.identifier)
+            logSuccess("Scheduled.", itemLogs, "send_at", gapOut.sendAt.Format(time.RFC3339))
+            return
+        }
+
+        // Apple would only throw it away, so don't bother sending it.
+        if !gapOut.expiresAt.IsZero() && gapOut.expiresAt.Before(time.Now()) {
+            pool.ReleaseConn(apns)
+            if !claim() {
+                return
+            }
+
+            expired := atomic.AddInt64(&stats.expired, 1)
+            itemLogs.info("Expired before sending, dropping it.", "expired", expired)
+            return
+        }
+
+        // Send the payload out. The connection goes back into the pool as
+        // soon as the frame is written, the result arrives later once Apple
+        // has had its chance to reject it.
+        if inFlight.takenBack(item) {
+            pool.ReleaseConn(apns)
+            return
+        }
+        sendStart := time.Now()
+        result := apns.SendPayload(gapOut.token, gapOut.jData, gapOut.expiresAt, gapOut.identifier, gapOut.priority)
+        // Up to the write for the binary protocol, its verdict only comes
+        // once ReadTimeout has passed. HTTP/2 answers before returning.
+        stats.observeLatency(time.Since(sendStart))
+        pool.ReleaseConn(apns)
+        err = <-result
+
+        if err == nil {
+            stats.delivered()
+        } else if apnsErr, ok := err.(*APNsError); ok {
+            stats.sendFailed(apnsErr.Status)
+        } else {
+            stats.sendFailed(0)
+        }
+
+        if !claim() {
+            return
+        }
+
+        // How many times we have tried this one, this attempt included.
+        attempts := 1
+        if retried, ok := jsonIn["_gapless_RETRYING"].(float64); ok {
+            attempts += int(retried)
+        }
+        itemLogs = itemLogs.with("attempt", attempts)
+        if apnsErr, ok := err.(*APNsError); ok {
+            itemLogs = itemLogs.with("status", apnsErr.Status, "reason", apnsErr.Reason)
+        }
+
+        // Some errors will never go away no matter how often we retry.
+        if apnsErr, ok := err.(*APNsError); ok && apnsErr.Permanent() {
+            itemLogs.warn("Permanent SendPayload error, not retrying.", "error", err)
+
+            // Invalid tokens go to their own sink, there's nothing to replay.
+            if !apnsErr.InvalidToken() {
+                giveUp(msg, err, attempts, jsonIn)
+            } else if invalidTokens != nil {
+                endErr := invalidTokens.publish(deadToken{
+                    token:      gapOut.token,
+                    timestamp:  time.Now(),
+                    reason:     apnsErr.Reason,
+                    identifier: &gapOut.identifier,
+                })
+                if endErr != nil {
+                    itemLogs.error("Publishing invalid token failed.", "token", itemLogs.token(gapOut.token), "error", endErr)
+                }
+            }
+            return
+        }
+
+        // If we get an error, we will retry.
+        if err != nil {
+            if attempts < retries.maxAttempts {
+                // Add (or bump) the _gapless_RETRYING key and send it back.
+                jsonIn["_gapless_RETRYING"] = attempts
+                if attempts == 1 {
+                    jsonIn["_gapless_FIRST_FAILED"] = time.Now().Unix()
+                }
+
+                delay := retries.delay(attempts)
+                retryAt := time.Now().Add(delay)
 
-            // If we get an error, we will retry.
+                // Also keeps identical retries apart in the sorted set.
+                jsonIn["_gapless_RETRY_AT"] = retryAt.UnixNano()
+                retryPayload, _ := json.Marshal(jsonIn)
+
+                itemLogs.warn("SendPayload error, retrying.", "error", err, "delay", delay)
+
+                endErr := source.Requeue(msg, string(retryPayload), retryAt)
+                if endErr != nil {
+                    itemLogs.error("Requeue failed.", "payload", itemLogs.payload(string(retryPayload)), "error", endErr)
+                    requeueFailed = true
+                    return
+                }
+                atomic.AddInt64(&stats.retried, 1)
+            } else {
+                itemLogs.warn("Final SendPayload error, giving up.", "error", err, "payload", itemLogs.payload(input))
+                giveUp(msg, err, attempts, jsonIn)
+            }
+        } else {
+            logSuccess("Sent.", itemLogs, "payload", itemLogs.payload(input))
+        }
+    }
+
+    // Receives items until we're stopped, sending each in its own goroutine.
+    consume := func(source Source, pool *connectionPoolWrapper) error {
+        for ctx.Err() == nil {
+            if !control.waitUntilResumed(ctx) {
+                continue
+            }
+
+            // Listen to our source, one item at a time.
+            msg, err := source.Receive()
             if err != nil {
-                // Have we retried yet?
-                result, present := jsonIn["_gapless_RETRYING"]
-                if !present {
-                    // Have not retried... add _gapless_RETRYING key and send it back.
-                    jsonIn["_gapless_RETRYING"] = 1
-                    retryPayload, _ := json.Marshal(jsonIn)
-
-                    stdout.Printf("SendPayload Error (ID %d): %s. Retrying count (1).", gapOut.identifier, err)
-
-                    _, endErr := outClient.LPush(queueKey, string(retryPayload))
-                    if endErr != nil {
-                        stderr.Printf("Redis LPush failed (%v): %s.", retryPayload, endErr)
-                        return
-                    }
-                } else if uint32(result.(float64)) < 3 {
-                    // Have not retried... add _gapless_RETRYING key and send it back.
-                    jsonIn["_gapless_RETRYING"] = uint32(result.(float64)) + 1
-                    retryPayload, _ := json.Marshal(jsonIn)
-
-                    stdout.Printf("SendPayload Error (ID %d): %s. Retrying count (%d).", gapOut.identifier, err, jsonIn["_gapless_RETRYING"])
-                    _, endErr := outClient.LPush(queueKey, string(retryPayload))
-                    if endErr != nil {
-                        stderr.Printf("Redis LPush failed (%v): %s.", retryPayload, endErr)
-                        return
-                    }
-                } else {
-                    stdout.Printf("Final SendPayload Error (ID %d): %s | %v.", gapOut.identifier, err, input)
+                return err
+            }
+            if msg == nil {
+                // Nothing came, check whether we should still be listening.
+                continue
+            }
+
+            // Paused while we were waiting on the source, give it back rather
+            // than let it slip past a drain.
+            var item *inFlightItem
+            if !control.unlessPaused(func() { item = inFlight.add(source, msg) }) {
+                err = source.Requeue(msg, msg.Body, time.Time{})
+                if err == nil {
+                    err = source.Ack(msg)
+                }
+                if err != nil {
+                    logs.error("Putting back a push received while pausing failed.", "queue", msg.Queue, "payload", logs.payload(msg.Body), "error", err)
                 }
-            } else if logSuccesses {
-                stdout.Printf("Sent: %s.", input)
+                continue
+            }
+            atomic.AddInt64(&stats.popped, 1)
+
+            // We grab a connection from the pool.
+            // This call will block until a connection is available again.
+            // If your still getting back logged, increase your pool size.
+            conn := pool.GetConn()
+
+            go process(item, pool, conn)
+        }
+        return nil
+    }
+
+    consumers := []func() error{
+        // Energizer loop.
+        func() error { return consume(source, connPool) },
+    }
+
+    // The reserved connections get a loop of their own, so the highest
+    // priority pushes never wait behind the others.
+    if reservedPool != nil {
+        consumers = append(consumers, func() error { return consume(reservedSource, reservedPool) })
+    }
+
+    // Run the consumers until we're stopped or one of them fails, which stops
+    // the rest. Then see the items already popped through.
+    errs := make(chan error, len(consumers))
+    for _, run := range consumers {
+        go func(run func() error) {
+            err := run()
+            cancel()
+            errs <- err
+        }(run)
+    }
+
+    var runErr error
+    for range consumers {
+        if err := <-errs; err != nil && runErr == nil {
+            runErr = err
+        }
+    }
+
+    // Give the pushes in flight a chance to finish (or be lined up for a
+    // retry), and put whatever didn't make it back on its queue.
+    timeout := time.Duration(settings.Float("shutdown_timeout", 30) * float64(time.Second))
+    if count := inFlight.count(); count > 0 {
+        logs.info("Stopping, waiting for the pushes in flight.", "timeout", timeout, "in_flight", count)
+    }
+
+    if !inFlight.wait(timeout) {
+        putBack := 0
+        for _, item := range inFlight.takeBack() {
+            err := item.source.Requeue(item.msg, item.msg.Body, time.Time{})
+            if err == nil {
+                err = item.source.Ack(item.msg)
+            }
+            if err != nil {
+                logs.error("Putting an unfinished push back failed.", "queue", item.msg.Queue, "payload", logs.payload(item.msg.Body), "error", err)
+                continue
+            }
+            putBack++
+        }
+        logs.info("Put unfinished pushes back on their queues.", "count", putBack)
+    }
+    return runErr
+}
+
+// How an app connects to Apple, as read from its settings.
+type apnsDialer struct {
+    dial    func() (apnsTransport, error)
+    certs   []tls.Certificate
+    tlsOpts tlsOptions
+}
+
+// Every connection dialed reports its handshakes to stats.
+func newApnsDialer(settings *DictObj, logs *appLog, stats *serviceStats) (*apnsDialer, error) {
+    // Prep our certificate file paths.
+    apnsCert := settingsPath(settings, "apns_cert_path")
+    apnsKey := settingsPath(settings, "apns_key_path")
+
+    // Token based authentication replaces the certificate entirely.
+    var signer *apnsTokenSigner
+    if authKey := settingsPath(settings, "apns_auth_key_path"); authKey != "" {
+        var err error
+        signer, err = loadApnsTokenSigner(authKey, settings.String("apns_key_id", ""), settings.String("apns_team_id", ""))
+        if err != nil {
+            return nil, errors.New(fmt.Sprintf("Loading the APNS signing key failed: %s.", err))
+        }
+        if settings.String("apns_transport", "binary") != "http2" {
+            return nil, errors.New("Token authentication requires 'apns_transport' to be 'http2'.")
+        }
+        if settings.String("apns_topic", "") == "" {
+            return nil, errors.New("Token authentication requires 'apns_topic' to be defined in your settings.")
+        }
+    }
+
+    // Prep how we talk TLS to Apple.
+    apnsServer := settings.String("apns_server")
+    passphrase, err := certPassphrase(settings)
+    if err != nil {
+        return nil, errors.New(fmt.Sprintf("Reading the certificate passphrase failed: %s.", err))
+    }
+
+    certs, err := loadApnsCertificate(apnsCert, apnsKey, passphrase)
+    if err != nil {
+        return nil, errors.New(fmt.Sprintf("Loading the APNS certificate failed: %s.", err))
+    }
+
+    tlsOpts := tlsOptions{
+        caPath:             settingsPath(settings, "apns_ca_path"),
+        pinnedPath:         settingsPath(settings, "apns_pinned_cert_path"),
+        insecureSkipVerify: settings.Bool("apns_insecure_skip_verify", false),
+    }
+    tlsCfg, err := newApnsTlsConfig(apnsServer, certs, tlsOpts)
+    if err != nil {
+        return nil, errors.New(fmt.Sprintf("Preparing the TLS config failed: %s.", err))
+    }
+    if settings.Bool("apns_insecure_skip_verify", false) {
+        logs.warn("'apns_insecure_skip_verify' is on, the APNS server is not being verified.")
+    }
+
+    // Pick which protocol we speak to Apple with.
+    apnsTopic := settings.String("apns_topic", "")
+    d := &apnsDialer{certs: certs, tlsOpts: tlsOpts}
+
+    switch settings.String("apns_transport", "binary") {
+    case "binary":
+        d.dial = func() (apnsTransport, error) {
+            conn, err := newApnsClient(apnsServer, tlsCfg)
+            if err != nil {
+                return nil, err
+            }
+            conn.onConnect = stats.connected
+            conn.log = logs
+            return conn, nil
+        }
+    case "http2":
+        d.dial = func() (apnsTransport, error) {
+            conn, err := newApnsHttp2Client(apnsServer, tlsCfg, apnsTopic, signer)
+            if err != nil {
+                return nil, err
             }
+            conn.onConnect = stats.connected
+            return conn, nil
+        }
+    default:
+        return nil, errors.New(fmt.Sprintf("Unknown 'apns_transport' (%s), expected 'binary' or 'http2'.", settings.String("apns_transport")))
+    }
+
+    return d, nil
+}
+
+// Returns a file path setting, made relative to the settings file when it
+// isn't absolute. Empty settings stay empty.
+func settingsPath(settings *DictObj, key string) string {
+    path := settings.String(key, "")
+    if path == "" || filepath.IsAbs(path) {
+        return path
+    }
+    return filepath.Dir(settings.ConfFile) + "/" + path
+}
+
+// The passphrase unlocking a .p12 bundle or encrypted key.
+func certPassphrase(settings *DictObj) (string, error) {
+    return secretSetting(settings, "apns_cert_passphrase")
+}
 
-        }(raw, conn)
+// A secret is never kept in the settings file itself, only the name of an env
+// var (key + "_env") or a file (key + "_file") holding it.
+func secretSetting(settings *DictObj, key string) (string, error) {
+    if envKey := settings.String(key+"_env", ""); envKey != "" {
+        envVal, ok := syscall.Getenv(envKey)
+        if !ok {
+            return "", errors.New(fmt.Sprintf("Environment variable %s is not set", envKey))
+        }
+        return envVal, nil
     }
+
+    if path := settingsPath(settings, key+"_file"); path != "" {
+        raw, err := os.ReadFile(path)
+        if err != nil {
+            return "", err
+        }
+        return strings.TrimRight(string(raw), "\r\n"), nil
+    }
+
+    return "", nil
 }
 
-func newRedisConn() *redis.Client {
+func newRedisConn(settings *DictObj) (*redis.Client, error) {
     r := redis.New()
-    err := r.Connect(Settings.String("redis_host", "127.0.0.1"), uint(Settings.Int("redis_port", 6379)))
+    err := r.Connect(settings.String("redis_host", "127.0.0.1"), uint(settings.Int("redis_port", 6379)))
     if err != nil {
-        stderr.Fatalf("Redis failed to initialize: %s.", err)
+        return nil, errors.New(fmt.Sprintf("Redis failed to initialize: %s.", err))
     }
 
     // Select our DB.
-    _, err = r.Select(int64(Settings.Int("redis_db", 0)))
+    _, err = r.Select(int64(settings.Int("redis_db", 0)))
     if err != nil {
-        stderr.Fatalf("Redis failed to select DB: %s.", err)
+        r.Quit()
+        return nil, errors.New(fmt.Sprintf("Redis failed to select DB: %s.", err))
     }
 
-    return r
+    return r, nil
 }
 
 func parseApnsJson(in map[string]interface{}) (*gapObj, error) {
@@ -170,9 +700,13 @@ func parseApnsJson(in map[string]interface{}) (*gapObj, error) {
     // Token
     result, present := in["token"]
     if !present {
-        return gap, errors.New(fmt.Sprintf("Json Data Error (%v): Token was missing.", in))
+        return gap, errors.New("Json Data Error: Token was missing.")
+    }
+    token, ok := result.(string)
+    if !ok {
+        return gap, fieldTypeError("token", "a hex string", result)
     }
-    gap.token, err = hex.DecodeString(result.(string))
+    gap.token, err = hex.DecodeString(token)
     if err != nil {
         return gap, err
     }
@@ -180,23 +714,74 @@ func parseApnsJson(in map[string]interface{}) (*gapObj, error) {
     // Identifier
     result, present = in["identifier"]
     if !present {
-        result = 0
+        result = float64(0)
+    }
+    identifier, ok := result.(float64)
+    if !ok {
+        return gap, fieldTypeError("identifier", "a number", result)
+    }
+    gap.identifier = uint32(identifier)
+
+    // Notification - Priority
+    result, present = in["priority"]
+    if present {
+        priority, ok := result.(float64)
+        if !ok {
+            return gap, fieldTypeError("priority", "a number", result)
+        }
+        if priority != 5 && priority != 10 {
+            return gap, errors.New(fmt.Sprintf("Priority must be 5 or 10, not %v.", priority))
+        }
+        gap.priority = uint8(priority)
+    }
+
+    // Notification - Scheduled delivery.
+    gap.sendAt, err = parseTimeField(in, "send_at")
+    if err != nil {
+        return gap, err
     }
-    gap.identifier = uint32(result.(float64))
 
     // Notification - Expiry
     result, present = in["expiry"]
     if !present {
-        result = 7200
+        result = float64(7200)
+    }
+    expiry, ok := result.(float64)
+    if !ok {
+        return gap, fieldTypeError("expiry", "a number", result)
+    }
+    gap.expiry = time.Duration(uint32(expiry)) * time.Second
+
+    // An absolute expires_at wins. Otherwise the relative expiry counts from
+    // when the item was queued (or is due, if later), not from when we got to
+    // it. An expiry of 0 leaves expiresAt zero, which means try once.
+    gap.expiresAt, err = parseTimeField(in, "expires_at")
+    if err != nil {
+        return gap, err
+    }
+    if gap.expiresAt.IsZero() && gap.expiry > 0 {
+        base, err := parseTimeField(in, "enqueued_at")
+        if err != nil {
+            return gap, err
+        }
+        if base.IsZero() {
+            base = time.Now()
+        }
+        if gap.sendAt.After(base) {
+            base = gap.sendAt
+        }
+        gap.expiresAt = base.Add(gap.expiry)
     }
-    gap.expiry = time.Duration(uint32(result.(float64))) * time.Second
 
     // Notification - Data
     result, present = in["data"]
     if !present {
-        return gap, errors.New(fmt.Sprintf("Missing data structure: %v.", in))
+        return gap, errors.New("Missing data structure.")
+    }
+    data, ok := result.(map[string]interface{})
+    if !ok {
+        return gap, fieldTypeError("data", "a dict", result)
     }
-    data := result.(map[string]interface{})
 
     // Wrap it back up.
     gap.jData, err = json.Marshal(data)
@@ -206,3 +791,30 @@ func parseApnsJson(in map[string]interface{}) (*gapObj, error) {
 
     return gap, nil
 }
+
+// Explains a field of the wrong type. Only says which type it was, the value
+// might be anything (the device token, say) and this ends up in the logs.
+func fieldTypeError(key, expected string, value interface{}) error {
+    return errors.New(fmt.Sprintf("The %s must be %s, not %T.", key, expected, value))
+}
+
+// Reads an optional timestamp, given as unix seconds or an RFC 3339 string.
+// Returns the zero time when the key isn't there.
+func parseTimeField(in map[string]interface{}, key string) (time.Time, error) {
+    result, present := in[key]
+    if !present {
+        return time.Time{}, nil
+    }
+
+    switch value := result.(type) {
+    case float64:
+        return time.Unix(0, int64(value*float64(time.Second))), nil
+    case string:
+        parsed, err := time.Parse(time.RFC3339, value)
+        if err != nil {
+            return parsed, errors.New(fmt.Sprintf("Invalid %s (%s): %s.", key, value, err))
+        }
+        return parsed, nil
+    }
+    return time.Time{}, errors.New(fmt.Sprintf("Invalid %s, expected a number or a string but got %T.", key, result))
+}
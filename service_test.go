@@ -4,6 +4,7 @@ import (
     "encoding/hex"
     "encoding/json"
     "github.com/cojac/assert"
+    "strings"
     "testing"
     "time"
 )
@@ -44,3 +45,130 @@ func TestServiceBadJson(t *testing.T) {
     _, err := parseApnsJson(jParsed)
     assert.NotEqual(t, nil, err)
 }
+
+func TestServicePriority(t *testing.T) {
+    strData := `{"token": "71c12814d8f7095df0bc4881fcd9163c81aede02c1ebc176a548e03a3943cb14", "priority": 5, "data": {"aps": {}}}`
+    jParsed := make(map[string]interface{})
+    _ = json.Unmarshal([]byte(strData), &jParsed)
+
+    result, err := parseApnsJson(jParsed)
+    assert.Equal(t, nil, err)
+    assert.Equal(t, uint8(5), result.priority)
+
+    jParsed["priority"] = float64(7)
+    _, err = parseApnsJson(jParsed)
+    assert.NotEqual(t, nil, err)
+
+    delete(jParsed, "priority")
+    result, err = parseApnsJson(jParsed)
+    assert.Equal(t, nil, err)
+    assert.Equal(t, uint8(0), result.priority)
+}
+
+func TestServiceSendAt(t *testing.T) {
+    strData := `{"token": "71c12814d8f7095df0bc4881fcd9163c81aede02c1ebc176a548e03a3943cb14", "send_at": 1400000000, "data": {"aps": {}}}`
+    jParsed := make(map[string]interface{})
+    _ = json.Unmarshal([]byte(strData), &jParsed)
+
+    result, err := parseApnsJson(jParsed)
+    assert.Equal(t, nil, err)
+    assert.Equal(t, int64(1400000000), result.sendAt.Unix())
+
+    jParsed["send_at"] = "2014-05-13T16:53:20Z"
+    result, err = parseApnsJson(jParsed)
+    assert.Equal(t, nil, err)
+    assert.Equal(t, int64(1400000000), result.sendAt.Unix())
+
+    jParsed["send_at"] = "tomorrow"
+    _, err = parseApnsJson(jParsed)
+    assert.NotEqual(t, nil, err)
+
+    delete(jParsed, "send_at")
+    result, err = parseApnsJson(jParsed)
+    assert.Equal(t, nil, err)
+    assert.Equal(t, true, result.sendAt.IsZero())
+}
+
+func TestServiceExpiresAt(t *testing.T) {
+    strData := `{"token": "71c12814d8f7095df0bc4881fcd9163c81aede02c1ebc176a548e03a3943cb14", "expiry": 60, "enqueued_at": 1400000000, "data": {"aps": {}}}`
+    jParsed := make(map[string]interface{})
+    _ = json.Unmarshal([]byte(strData), &jParsed)
+
+    // Relative expiry counts from when it was queued.
+    result, err := parseApnsJson(jParsed)
+    assert.Equal(t, nil, err)
+    assert.Equal(t, int64(1400000060), result.expiresAt.Unix())
+
+    // Or from when it is due, if that's later.
+    jParsed["send_at"] = float64(1400000100)
+    result, err = parseApnsJson(jParsed)
+    assert.Equal(t, nil, err)
+    assert.Equal(t, int64(1400000160), result.expiresAt.Unix())
+
+    // An absolute expiration wins.
+    jParsed["expires_at"] = "2014-05-13T16:53:20Z"
+    result, err = parseApnsJson(jParsed)
+    assert.Equal(t, nil, err)
+    assert.Equal(t, int64(1400000000), result.expiresAt.Unix())
+
+    jParsed["expires_at"] = "never"
+    _, err = parseApnsJson(jParsed)
+    assert.NotEqual(t, nil, err)
+
+    // Zero means try once, which goes out as no expiration at all.
+    delete(jParsed, "expires_at")
+    jParsed["expiry"] = float64(0)
+    result, err = parseApnsJson(jParsed)
+    assert.Equal(t, nil, err)
+    assert.Equal(t, true, result.expiresAt.IsZero())
+}
+
+// Parse errors get logged, so they mustn't carry the token or the alert.
+func TestServiceParseErrorsLeaveOutContent(t *testing.T) {
+    strData := `{"token": "71c12814d8f7095df0bc4881fcd9163c81aede02c1ebc176a548e03a3943cb14", "priority": 7, "data": {"aps": {"alert": "secret body"}}}`
+    jParsed := make(map[string]interface{})
+    _ = json.Unmarshal([]byte(strData), &jParsed)
+
+    check := func() {
+        _, err := parseApnsJson(jParsed)
+        assert.NotEqual(t, nil, err)
+        assert.Equal(t, false, strings.Contains(err.Error(), "71c12814"))
+        assert.Equal(t, false, strings.Contains(err.Error(), "secret body"))
+    }
+
+    check()
+
+    delete(jParsed, "priority")
+    jParsed["send_at"] = true
+    check()
+
+    delete(jParsed, "send_at")
+    delete(jParsed, "data")
+    check()
+}
+
+// Valid json with a field of the wrong type is an error, not a panic.
+func TestServiceWrongTypes(t *testing.T) {
+    fields := map[string]interface{}{
+        "token":       float64(12),
+        "identifier":  "9",
+        "priority":    "10",
+        "expiry":      "3600",
+        "send_at":     true,
+        "expires_at":  []interface{}{},
+        "enqueued_at": map[string]interface{}{},
+        "data":        "hello",
+    }
+
+    for key, value := range fields {
+        jParsed := map[string]interface{}{
+            "token": "71c12814d8f7095df0bc4881fcd9163c81aede02c1ebc176a548e03a3943cb14",
+            "data":  map[string]interface{}{"aps": map[string]interface{}{}},
+        }
+        jParsed[key] = value
+
+        _, err := parseApnsJson(jParsed)
+        assert.NotEqual(t, nil, err)
+        assert.Equal(t, true, strings.Contains(err.Error(), key))
+    }
+}
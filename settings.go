@@ -6,6 +6,7 @@ import (
     "fmt"
     "os"
     "reflect"
+    "strings"
     "syscall"
 )
 
@@ -151,3 +152,67 @@ func (s *DictObj) String(key string, args ...string) string {
     }
     return result.(string)
 }
+
+// List returns a list settings value, nil when it isn't set and an error when
+// it isn't a list.
+func (s *DictObj) List(key string) ([]interface{}, error) {
+    result, present := s.data[key]
+    if !present {
+        return nil, nil
+    }
+    list, ok := result.([]interface{})
+    if !ok {
+        return nil, fieldTypeError("'"+key+"'", "a list", result)
+    }
+    return list, nil
+}
+
+// Map returns a dict settings value, nil when it isn't set and an error when
+// it isn't a dict.
+func (s *DictObj) Map(key string) (map[string]interface{}, error) {
+    result, present := s.data[key]
+    if !present {
+        return nil, nil
+    }
+    dict, ok := result.(map[string]interface{})
+    if !ok {
+        return nil, fieldTypeError("'"+key+"'", "a dict", result)
+    }
+    return dict, nil
+}
+
+// Overlay returns a copy of the settings with the given values on top.
+func (s *DictObj) Overlay(data map[string]interface{}) *DictObj {
+    out := &DictObj{data: make(map[string]interface{}), ConfFile: s.ConfFile}
+    for key, val := range s.data {
+        out.data[key] = val
+    }
+    for key, val := range data {
+        out.data[key] = val
+    }
+    return out
+}
+
+// Settings whose names end in any of these hold secrets.
+var secretSuffixes = []string{"_token", "_passphrase", "_password", "_secret"}
+
+// A copy of the settings safe to show, with every secret replaced.
+func (s *DictObj) redacted() map[string]interface{} {
+    return redactSettings(s.data)
+}
+
+func redactSettings(data map[string]interface{}) map[string]interface{} {
+    out := make(map[string]interface{})
+    for key, val := range data {
+        if nested, ok := val.(map[string]interface{}); ok {
+            val = redactSettings(nested)
+        }
+        for _, suffix := range secretSuffixes {
+            if strings.HasSuffix(key, suffix) {
+                val = "[redacted]"
+            }
+        }
+        out[key] = val
+    }
+    return out
+}
@@ -122,3 +122,56 @@ func TestDictObjString(t *testing.T) {
         dictObj.String("z", "default", "bad")
     })
 }
+
+func TestDictObjList(t *testing.T) {
+    dictObj := NewSettingsObj()
+
+    dictObj.Set("a", []interface{}{"AAA", "BBB"})
+
+    list, err := dictObj.List("a")
+    assert.Equal(t, nil, err)
+    assert.Equal(t, 2, len(list))
+    assert.Equal(t, "BBB", list[1])
+
+    list, err = dictObj.List("b")
+    assert.Equal(t, nil, err)
+    assert.Equal(t, 0, len(list))
+
+    dictObj.Set("c", "AAA")
+    _, err = dictObj.List("c")
+    assert.Equal(t, "The 'c' must be a list, not string.", err.Error())
+}
+
+func TestDictObjMap(t *testing.T) {
+    dictObj := NewSettingsObj()
+
+    dictObj.Set("a", map[string]interface{}{"b": "BBB"})
+
+    dict, err := dictObj.Map("a")
+    assert.Equal(t, nil, err)
+    assert.Equal(t, "BBB", dict["b"])
+
+    dict, err = dictObj.Map("c")
+    assert.Equal(t, nil, err)
+    assert.Equal(t, 0, len(dict))
+
+    dictObj.Set("d", []interface{}{"b"})
+    _, err = dictObj.Map("d")
+    assert.Equal(t, "The 'd' must be a dict, not []interface {}.", err.Error())
+}
+
+func TestDictObjOverlay(t *testing.T) {
+    dictObj := NewSettingsObj()
+    dictObj.Set("a", "AAA")
+    dictObj.Set("b", "BBB")
+
+    overlay := dictObj.Overlay(map[string]interface{}{"b": "not BBB", "c": "CCC"})
+
+    assert.Equal(t, "AAA", overlay.String("a"))
+    assert.Equal(t, "not BBB", overlay.String("b"))
+    assert.Equal(t, "CCC", overlay.String("c"))
+
+    // The original is left alone.
+    assert.Equal(t, "BBB", dictObj.String("b"))
+    assert.Equal(t, "", dictObj.String("c"))
+}
@@ -0,0 +1,68 @@
+package gapless
+
+import (
+    "encoding/hex"
+    "encoding/json"
+    "errors"
+    "sync"
+    "time"
+)
+
+// A device token which should no longer be pushed to.
+type deadToken struct {
+    token     []byte
+    timestamp time.Time
+    reason    string
+    // Identifier of the notification which found out, nil for feedback.
+    identifier *uint32
+}
+
+// Publishes dead tokens to redis so apps can prune them. The sink is either a
+// set of hex tokens, or a list or pub/sub channel of json objects:
+//
+//    {"token": "71c1...", "timestamp": 1400000000, "reason": "Invalid Token", "identifier": 9}
+//
+// The timestamp lets apps ignore devices which registered again since.
+type tokenSink struct {
+    client  redisClient
+    key     string
+    keyType string
+    mu      sync.Mutex
+}
+
+// Checks the sink type is one we know how to publish to.
+func validSinkType(keyType string) bool {
+    return keyType == "set" || keyType == "list" || keyType == "publish"
+}
+
+func (p *tokenSink) publish(dead deadToken) (err error) {
+    token := hex.EncodeToString(dead.token)
+
+    p.mu.Lock()
+    defer p.mu.Unlock()
+
+    if p.keyType == "set" {
+        _, err = p.client.SAdd(p.key, token)
+        return err
+    }
+
+    raw, err := json.Marshal(struct {
+        Token      string  `json:"token"`
+        Timestamp  int64   `json:"timestamp"`
+        Reason     string  `json:"reason"`
+        Identifier *uint32 `json:"identifier,omitempty"`
+    }{token, dead.timestamp.Unix(), dead.reason, dead.identifier})
+    if err != nil {
+        return err
+    }
+
+    switch p.keyType {
+    case "list":
+        _, err = p.client.RPush(p.key, string(raw))
+    case "publish":
+        _, err = p.client.Publish(p.key, string(raw))
+    default:
+        err = errors.New("Unknown sink type (" + p.keyType + "), expected 'set', 'list' or 'publish'")
+    }
+    return err
+}
@@ -0,0 +1,61 @@
+package gapless
+
+import (
+    "github.com/cojac/assert"
+    "testing"
+    "time"
+)
+
+func testDeadToken(identifier *uint32) deadToken {
+    return deadToken{
+        token:      []byte{0x71, 0xc1, 0x28, 0x14},
+        timestamp:  time.Unix(1400000000, 0),
+        reason:     "Invalid Token",
+        identifier: identifier,
+    }
+}
+
+func TestSinkSet(t *testing.T) {
+    client := newFakeRedis()
+    sink := &tokenSink{client: client, key: "invalid", keyType: "set"}
+
+    assert.Equal(t, nil, sink.publish(testDeadToken(nil)))
+    assert.Equal(t, nil, sink.publish(testDeadToken(nil)))
+
+    members, _ := client.SMembers("invalid")
+    assert.Equal(t, []string{"71c12814"}, members)
+}
+
+func TestSinkList(t *testing.T) {
+    client := newFakeRedis()
+    sink := &tokenSink{client: client, key: "invalid", keyType: "list"}
+
+    identifier := uint32(9)
+    assert.Equal(t, nil, sink.publish(testDeadToken(&identifier)))
+    assert.Equal(t, nil, sink.publish(testDeadToken(nil)))
+
+    // Feedback doesn't know the identifier, so leaves it out.
+    assert.Equal(t, []string{
+        `{"token":"71c12814","timestamp":1400000000,"reason":"Invalid Token","identifier":9}`,
+        `{"token":"71c12814","timestamp":1400000000,"reason":"Invalid Token"}`,
+    }, client.list("invalid"))
+}
+
+func TestSinkPublish(t *testing.T) {
+    client := newFakeRedis()
+    sink := &tokenSink{client: client, key: "invalid", keyType: "publish"}
+
+    assert.Equal(t, nil, sink.publish(testDeadToken(nil)))
+    assert.Equal(t, []string{`{"token":"71c12814","timestamp":1400000000,"reason":"Invalid Token"}`}, client.published["invalid"])
+    assert.Equal(t, []string{}, client.list("invalid"))
+}
+
+func TestSinkUnknownType(t *testing.T) {
+    client := newFakeRedis()
+    sink := &tokenSink{client: client, key: "invalid", keyType: "hash"}
+
+    assert.NotEqual(t, nil, sink.publish(testDeadToken(nil)))
+    assert.Equal(t, false, validSinkType("hash"))
+    exists, _ := client.Exists("invalid")
+    assert.Equal(t, false, exists)
+}
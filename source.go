@@ -0,0 +1,179 @@
+package gapless
+
+import (
+    "context"
+    "errors"
+    "fmt"
+    "github.com/gosexy/redis"
+    "time"
+)
+
+// Source is where an app's notifications come from. The rest of the pipeline
+// (parsing, the connection pool, sending and retrying) only ever deals with
+// messages through it.
+//
+// Every message received is either acked once it's been dealt with, or
+// handed back through Requeue or Schedule and then acked.
+type Source interface {
+    // Receive returns the next message, or nil when none arrived in a second
+    // or so, so the caller can check whether it should still be listening.
+    Receive() (*Message, error)
+    // Ack marks a message as dealt with.
+    Ack(msg *Message) error
+    // Requeue hands body (msg, or an updated copy of it) back to be received
+    // again once at has passed, straight away and ahead of everything else
+    // if it already has.
+    Requeue(msg *Message, body string, at time.Time) error
+    // Schedule holds a message back until at, its send_at, in a way that
+    // lets it be cancelled by its identifier until then.
+    Schedule(msg *Message, at time.Time, identifier uint32) error
+}
+
+// Message is a single notification as received from a Source.
+type Message struct {
+    Body string
+    // The name of the queue it came from, for logs and dead letters.
+    Queue string
+    // Whatever the source needs to ack or requeue the message later.
+    Handle interface{}
+}
+
+// The redis lists of an app as a Source, each list a lane with sorted sets
+// of its own for retries and scheduled pushes. See queue.go and lanes.go.
+type redisSource struct {
+    lanes *queueLanes
+}
+
+var _ Source = &redisSource{}
+
+// Opens the app's redis lists and starts what keeps them going in the
+// background, the heartbeats of reliable mode and moving due retries and
+// scheduled pushes back onto the lists. Connections come from conn, background
+// tasks are started with background.
+//
+// With reserved set a second source is returned, taking from just the first
+// list on redis connections of its own, for the reserved connections.
+func newRedisSources(ctx context.Context, settings *DictObj, logs *appLog, conn func() (*redis.Client, error), background func(func()), reserved bool) (*redisSource, *redisSource, error) {
+    inClient, err := conn()
+    if err != nil {
+        return nil, nil, err
+    }
+    outClient, err := conn()
+    if err != nil {
+        return nil, nil, err
+    }
+
+    // The redis queue keys to be used, highest priority first.
+    queueKeyList, weights, err := queueKeys(settings)
+    if err != nil {
+        return nil, nil, err
+    }
+
+    weighted := false
+    switch mode := settings.String("redis_queue_mode", "strict"); mode {
+    case "strict":
+    case "weighted":
+        weighted = true
+    default:
+        return nil, nil, errors.New(fmt.Sprintf("Unknown 'redis_queue_mode' (%s), expected 'strict' or 'weighted'.", mode))
+    }
+
+    reliable := settings.Bool("reliable_queue", false)
+    instance := settings.String("instance_id", defaultInstanceId())
+
+    lanes := []*queueLane{}
+    for x, queueKey := range queueKeyList {
+        // In reliable mode, put back whatever a previous run under the same
+        // instance id left behind, and start watching over the other instances.
+        queue := newRedisQueue(inClient, outClient, queueKey, reliable, instance, logs)
+        if queue.reliable {
+            heartbeatClient, err := conn()
+            if err != nil {
+                return nil, nil, err
+            }
+
+            err = queue.recoverInstance(heartbeatClient, queue.instance)
+            if err != nil {
+                return nil, nil, errors.New(fmt.Sprintf("Recovering our processing list failed: %s.", err))
+            }
+            background(func() { queue.heartbeat(ctx, heartbeatClient) })
+        }
+
+        // Retries and pushes with a send_at in the future each wait in a
+        // sorted set of the lane's own.
+        retryKey, scheduleKey := delayedKeys(settings, queueKey, len(queueKeyList) == 1)
+
+        lane := &queueLane{
+            queue:     queue,
+            weight:    weights[x],
+            retries:   &delayedSet{key: retryKey, log: logs},
+            scheduled: &delayedSet{key: scheduleKey, indexed: true, log: logs},
+        }
+        lane.retries.client, err = conn()
+        if err != nil {
+            return nil, nil, err
+        }
+        lane.scheduled.client, err = conn()
+        if err != nil {
+            return nil, nil, err
+        }
+        background(func() { lane.retries.promote(ctx, queue) })
+        background(func() { lane.scheduled.promote(ctx, queue) })
+
+        lanes = append(lanes, lane)
+    }
+
+    source := &redisSource{lanes: newQueueLanes(inClient, lanes, weighted)}
+    if !reserved {
+        return source, nil, nil
+    }
+
+    // The reserved connections only ever serve the highest priority lane,
+    // popped (and acked) on redis connections of their own so it never waits
+    // behind the others.
+    top := lanes[0]
+    reservedIn, err := conn()
+    if err != nil {
+        return nil, nil, err
+    }
+    reservedOut, err := conn()
+    if err != nil {
+        return nil, nil, err
+    }
+
+    reservedLane := &queueLane{
+        queue:     newRedisQueue(reservedIn, reservedOut, top.queue.key, reliable, instance, logs),
+        weight:    top.weight,
+        retries:   top.retries,
+        scheduled: top.scheduled,
+    }
+    return source, &redisSource{lanes: newQueueLanes(reservedIn, []*queueLane{reservedLane}, false)}, nil
+}
+
+func (s *redisSource) Receive() (*Message, error) {
+    lane, raw, err := s.lanes.pop()
+    if err != nil {
+        return nil, errors.New(fmt.Sprintf("Redis pop failed: %s.", err))
+    }
+    if lane == nil {
+        return nil, nil
+    }
+    return &Message{Body: raw, Queue: lane.queue.key, Handle: lane}, nil
+}
+
+func (s *redisSource) Ack(msg *Message) error {
+    return msg.Handle.(*queueLane).queue.ack(msg.Body)
+}
+
+// Retries which aren't due yet wait in the lane's retry set.
+func (s *redisSource) Requeue(msg *Message, body string, at time.Time) error {
+    lane := msg.Handle.(*queueLane)
+    if at.After(time.Now()) {
+        return lane.retries.add(body, at, 0)
+    }
+    return lane.queue.requeue(body)
+}
+
+func (s *redisSource) Schedule(msg *Message, at time.Time, identifier uint32) error {
+    return msg.Handle.(*queueLane).scheduled.add(msg.Body, at, identifier)
+}
@@ -0,0 +1,155 @@
+package gapless
+
+import (
+    "context"
+    "github.com/cojac/assert"
+    "github.com/cojac/gapless/apnstest"
+    "os"
+    "path/filepath"
+    "strconv"
+    "strings"
+    "sync"
+    "testing"
+    "time"
+)
+
+// A Source handing out a fixed list of bodies, and noting what became of them.
+type fakeSource struct {
+    mu        sync.Mutex
+    pending   []string
+    acked     []string
+    requeued  []string
+    scheduled []string
+}
+
+// Waits a little when there's nothing left, like a pop timing out.
+func (s *fakeSource) Receive() (*Message, error) {
+    s.mu.Lock()
+    if len(s.pending) == 0 {
+        s.mu.Unlock()
+        time.Sleep(10 * time.Millisecond)
+        return nil, nil
+    }
+    body := s.pending[0]
+    s.pending = s.pending[1:]
+    s.mu.Unlock()
+
+    return &Message{Body: body, Queue: "fake"}, nil
+}
+
+func (s *fakeSource) Ack(msg *Message) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    s.acked = append(s.acked, msg.Body)
+    return nil
+}
+
+func (s *fakeSource) Requeue(msg *Message, body string, at time.Time) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    s.requeued = append(s.requeued, body)
+    return nil
+}
+
+func (s *fakeSource) Schedule(msg *Message, at time.Time, identifier uint32) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    s.scheduled = append(s.scheduled, msg.Body)
+    return nil
+}
+
+// How many messages have been acked so far.
+func (s *fakeSource) ackedCount() int {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    return len(s.acked)
+}
+
+// Settings for an app sending to the mock server over HTTP/2, so nothing
+// needs redis.
+func testSourceSettings(t *testing.T, s *apnstest.Server) *DictObj {
+    pinned := filepath.Join(t.TempDir(), "server.pem")
+    err := os.WriteFile(pinned, s.CertPEM(), 0600)
+    assert.Equal(t, nil, err)
+
+    cert, _ := filepath.Abs("testdata/cert.pem")
+    key, _ := filepath.Abs("testdata/key.pem")
+
+    cfg := NewSettingsObj()
+    cfg.Set("apns_server", s.Addr)
+    cfg.Set("apns_transport", "http2")
+    cfg.Set("apns_cert_path", cert)
+    cfg.Set("apns_key_path", key)
+    cfg.Set("apns_pinned_cert_path", pinned)
+    cfg.Set("pool_size", float64(1))
+    return cfg
+}
+
+func TestServerUseSource(t *testing.T) {
+    s := apnstest.NewHTTP2Server()
+    defer s.Close()
+
+    s.Handle(func(n apnstest.Notification) apnstest.Response {
+        if n.Token[0] == 0xee {
+            return apnstest.Response{Reason: "ServiceUnavailable"}
+        }
+        return apnstest.Response{}
+    })
+
+    later := time.Now().Add(time.Hour).Unix()
+    source := &fakeSource{pending: []string{
+        `{"token":"abcd","identifier":1,"data":{"aps":{}}}`,
+        `{"token":"eeee","identifier":2,"data":{"aps":{}}}`,
+        `{"token":"abcd","identifier":3,"send_at":` + strconv.FormatInt(later, 10) + `,"data":{"aps":{}}}`,
+        `not json`,
+    }}
+
+    // Nothing is asked of redis, not even by the HTTP endpoints.
+    cfg := testSourceSettings(t, s)
+    cfg.Set("http_listen", "127.0.0.1:0")
+
+    server, err := New(cfg)
+    assert.Equal(t, nil, err)
+    assert.Equal(t, nil, server.UseSource("", source))
+    assert.NotEqual(t, nil, server.UseSource("beta", source))
+
+    ctx, cancel := context.WithCancel(context.Background())
+    done := make(chan error)
+    go func() { done <- server.Run(ctx) }()
+
+    deadline := time.Now().Add(5 * time.Second)
+    for source.ackedCount() < 4 && time.Now().Before(deadline) {
+        time.Sleep(10 * time.Millisecond)
+    }
+    cancel()
+    assert.Equal(t, nil, <-done)
+
+    // Everything is acked, the failure once it's lined up for a retry and
+    // the scheduled push once it's been handed back.
+    assert.Equal(t, 4, len(source.acked))
+    assert.Equal(t, 1, len(source.requeued))
+    assert.Equal(t, 1, len(source.scheduled))
+    assert.Equal(t, 1, len(s.Notifications()))
+    assert.Equal(t, uint32(1), s.Notifications()[0].Identifier)
+}
+
+func TestServerUseSourceReserved(t *testing.T) {
+    s := apnstest.NewHTTP2Server()
+    defer s.Close()
+
+    cfg := testSourceSettings(t, s)
+    cfg.Set("pool_size", float64(2))
+    cfg.Set("reserved_connections", float64(1))
+
+    server, err := New(cfg)
+    assert.Equal(t, nil, err)
+    server.UseSource("", &fakeSource{})
+
+    err = server.Run(context.Background())
+    assert.NotEqual(t, nil, err)
+    assert.Equal(t, true, strings.Contains(err.Error(), "'reserved_connections'"))
+}
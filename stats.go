@@ -0,0 +1,154 @@
+package gapless
+
+import (
+    "sort"
+    "sync"
+    "sync/atomic"
+    "time"
+)
+
+// Upper bounds (in seconds) of the send latency histogram's buckets.
+var latencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// Running totals, for logging and monitoring. The counters are only ever
+// touched through sync/atomic, everything else under mu.
+type serviceStats struct {
+    popped       int64
+    sent         int64
+    retried      int64
+    deadLettered int64
+    malformed    int64
+    expired      int64
+    handshakes   int64
+    reconnects   int64
+    // Unix nanoseconds of the last successful handshake, and of the last push
+    // Apple accepted.
+    lastHandshake int64
+    lastSent      int64
+
+    mu sync.Mutex
+    // Failed sends by APNs status, 0 for those which failed without one.
+    failed map[uint8]int64
+    // Send latencies, a count per latency bucket plus one for everything slower.
+    latencyCounts []int64
+    latencySum    float64
+    pools         []*connectionPoolWrapper
+    queueDepths   map[string]int64
+    // The outcome of the last redis health check, and when it was.
+    redisErr       error
+    redisCheckedAt time.Time
+    // The outcome of the last call to the app's source, by what was called.
+    sourceErrs map[string]error
+}
+
+func newServiceStats() *serviceStats {
+    return &serviceStats{
+        failed:        make(map[uint8]int64),
+        latencyCounts: make([]int64, len(latencyBuckets)+1),
+        queueDepths:   make(map[string]int64),
+        sourceErrs:    make(map[string]error),
+    }
+}
+
+// Every app's stats, by app name ("" when there's no 'apps' section).
+var appStats = struct {
+    sync.Mutex
+    byApp map[string]*serviceStats
+}{byApp: make(map[string]*serviceStats)}
+
+// Returns the stats for an app, creating them the first time.
+func statsFor(name string) *serviceStats {
+    appStats.Lock()
+    defer appStats.Unlock()
+
+    stats, ok := appStats.byApp[name]
+    if !ok {
+        stats = newServiceStats()
+        appStats.byApp[name] = stats
+    }
+    return stats
+}
+
+func (s *serviceStats) sendFailed(status uint8) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    s.failed[status]++
+}
+
+func (s *serviceStats) observeLatency(d time.Duration) {
+    seconds := d.Seconds()
+    bucket := sort.SearchFloat64s(latencyBuckets, seconds)
+
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    s.latencyCounts[bucket]++
+    s.latencySum += seconds
+}
+
+// Hooked up to every connection, see onConnect.
+func (s *serviceStats) connected(reconnect bool) {
+    atomic.AddInt64(&s.handshakes, 1)
+    atomic.StoreInt64(&s.lastHandshake, time.Now().UnixNano())
+    if reconnect {
+        atomic.AddInt64(&s.reconnects, 1)
+    }
+}
+
+// The pools whose connections are reported on, replacing any from before.
+// Nil pools are skipped.
+func (s *serviceStats) setPools(pools ...*connectionPoolWrapper) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    s.pools = nil
+    for _, pool := range pools {
+        if pool != nil {
+            s.pools = append(s.pools, pool)
+        }
+    }
+}
+
+// Returns how many pooled connections are in use and how many are idle.
+func (s *serviceStats) poolUsage() (busy, idle int) {
+    s.mu.Lock()
+    pools := s.pools
+    s.mu.Unlock()
+
+    for _, pool := range pools {
+        free := pool.idle()
+        busy += pool.connections() - free
+        idle += free
+    }
+    return busy, idle
+}
+
+func (s *serviceStats) redisChecked(err error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    s.redisErr = err
+    s.redisCheckedAt = time.Now()
+}
+
+// Records how a call to the app's source went, see watchedSource.
+func (s *serviceStats) sourceUsed(call string, err error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    s.sourceErrs[call] = err
+}
+
+// A push Apple accepted.
+func (s *serviceStats) delivered() {
+    atomic.AddInt64(&s.sent, 1)
+    atomic.StoreInt64(&s.lastSent, time.Now().UnixNano())
+}
+
+func (s *serviceStats) setQueueDepth(key string, depth int64) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    s.queueDepths[key] = depth
+}
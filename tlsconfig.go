@@ -0,0 +1,305 @@
+package gapless
+
+import (
+    "bytes"
+    "crypto/aes"
+    "crypto/cipher"
+    "crypto/des"
+    "crypto/sha1"
+    "crypto/sha256"
+    "crypto/tls"
+    "crypto/x509"
+    "crypto/x509/pkix"
+    "encoding/asn1"
+    "encoding/pem"
+    "errors"
+    "fmt"
+    "golang.org/x/crypto/pbkdf2"
+    "hash"
+    "net"
+    "os"
+    "path/filepath"
+    "software.sslmate.com/src/go-pkcs12"
+    "strings"
+)
+
+// Controls how Apple's servers (or a mock standing in for them) are verified.
+type tlsOptions struct {
+    // PEM bundle of root certificates to trust instead of the system roots.
+    caPath string
+    // PEM certificate the server has to present exactly. Chain and host name
+    // checks are skipped in favour of the pin, which suits self signed mocks.
+    pinnedPath string
+    // Turns off every check. Only ever meant for local testing.
+    insecureSkipVerify bool
+}
+
+// Builds the TLS config shared by every connection to the endpoint.
+// Certificates may be empty when token authentication is used.
+func newApnsTlsConfig(endpoint string, certs []tls.Certificate, opts tlsOptions) (*tls.Config, error) {
+    host, _, err := net.SplitHostPort(endpoint)
+    if err != nil {
+        return nil, err
+    }
+
+    cfg := &tls.Config{
+        ServerName:   host,
+        Certificates: certs,
+    }
+
+    if opts.caPath != "" {
+        raw, err := os.ReadFile(opts.caPath)
+        if err != nil {
+            return nil, err
+        }
+
+        cfg.RootCAs = x509.NewCertPool()
+        if !cfg.RootCAs.AppendCertsFromPEM(raw) {
+            return nil, errors.New(fmt.Sprintf("No certificates found in CA bundle: %s", opts.caPath))
+        }
+    }
+
+    if opts.pinnedPath != "" {
+        raw, err := os.ReadFile(opts.pinnedPath)
+        if err != nil {
+            return nil, err
+        }
+
+        block, _ := pem.Decode(raw)
+        if block == nil {
+            return nil, errors.New(fmt.Sprintf("No PEM data found in pinned certificate: %s", opts.pinnedPath))
+        }
+        pinned := block.Bytes
+
+        // The pin replaces the normal checks, so they have to be turned off.
+        cfg.InsecureSkipVerify = true
+        cfg.VerifyPeerCertificate = func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+            if len(rawCerts) == 0 || !bytes.Equal(rawCerts[0], pinned) {
+                return errors.New("Server certificate does not match the pinned certificate")
+            }
+            return nil
+        }
+    }
+
+    if opts.insecureSkipVerify {
+        cfg.InsecureSkipVerify = true
+        cfg.VerifyPeerCertificate = nil
+    }
+
+    return cfg, nil
+}
+
+// Loads the client certificate. Returns nothing when no path is set, which is
+// the case for token authentication.
+//
+// The certificate can be a .p12/.pfx bundle as exported by Keychain, or PEM.
+// With PEM the key may live in the same file as the certificate, and may be
+// encrypted. The passphrase is used to unlock whichever needs it.
+func loadApnsCertificate(certificate, key, passphrase string) ([]tls.Certificate, error) {
+    if certificate == "" {
+        return nil, nil
+    }
+
+    certPEM, err := os.ReadFile(certificate)
+    if err != nil {
+        return nil, err
+    }
+
+    switch strings.ToLower(filepath.Ext(certificate)) {
+    case ".p12", ".pfx":
+        privateKey, leaf, caCerts, err := pkcs12.DecodeChain(certPEM, passphrase)
+        if err != nil {
+            return nil, errors.New(fmt.Sprintf("Decoding PKCS#12 bundle failed: %s", err))
+        }
+
+        cert := tls.Certificate{
+            Certificate: [][]byte{leaf.Raw},
+            PrivateKey:  privateKey,
+            Leaf:        leaf,
+        }
+        for _, ca := range caCerts {
+            cert.Certificate = append(cert.Certificate, ca.Raw)
+        }
+        return []tls.Certificate{cert}, nil
+    }
+
+    keyPEM := certPEM
+    if key != "" {
+        keyPEM, err = os.ReadFile(key)
+        if err != nil {
+            return nil, err
+        }
+    }
+
+    keyPEM, err = decryptPEMKey(keyPEM, passphrase)
+    if err != nil {
+        return nil, err
+    }
+
+    cert, err := tls.X509KeyPair(certPEM, keyPEM)
+    if err != nil {
+        return nil, err
+    }
+    return []tls.Certificate{cert}, nil
+}
+
+// Finds the private key within the PEM data, decrypting it when it was
+// exported with a passphrase. Returns just the (decrypted) key block.
+func decryptPEMKey(data []byte, passphrase string) ([]byte, error) {
+    for {
+        var block *pem.Block
+        block, data = pem.Decode(data)
+        if block == nil {
+            return nil, errors.New("No private key found in PEM data")
+        }
+        if !strings.HasSuffix(block.Type, "PRIVATE KEY") {
+            continue
+        }
+
+        encrypted := block.Type == "ENCRYPTED PRIVATE KEY" || x509.IsEncryptedPEMBlock(block)
+        if !encrypted {
+            return pem.EncodeToMemory(block), nil
+        }
+        if passphrase == "" {
+            return nil, errors.New("The private key is encrypted but no passphrase was given")
+        }
+
+        // Encrypted PKCS#8 is what openssl produces since 3.0. Otherwise it's
+        // the deprecated legacy PEM encryption (the Proc-Type and DEK-Info
+        // headers) of older versions, or of -traditional.
+        var der []byte
+        var err error
+        keyType := block.Type
+        if block.Type == "ENCRYPTED PRIVATE KEY" {
+            der, err = decryptPKCS8(block.Bytes, passphrase)
+            keyType = "PRIVATE KEY"
+        } else {
+            der, err = x509.DecryptPEMBlock(block, []byte(passphrase))
+        }
+        if err != nil {
+            return nil, errors.New(fmt.Sprintf("Decrypting the private key failed: %s", err))
+        }
+        return pem.EncodeToMemory(&pem.Block{Type: keyType, Bytes: der}), nil
+    }
+}
+
+var (
+    oidPBES2      = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 13}
+    oidPBKDF2     = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 12}
+    oidHmacSHA1   = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 7}
+    oidHmacSHA256 = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 9}
+    oidAES128CBC  = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 2}
+    oidAES192CBC  = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 22}
+    oidAES256CBC  = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 42}
+    oidDESEDE3CBC = asn1.ObjectIdentifier{1, 2, 840, 113549, 3, 7}
+)
+
+// The ASN.1 structures of an encrypted PKCS#8 key, see RFC 5958 and RFC 8018.
+type encryptedPrivateKeyInfo struct {
+    Algorithm pkix.AlgorithmIdentifier
+    Data      []byte
+}
+
+type pbes2Params struct {
+    KeyDerivation pkix.AlgorithmIdentifier
+    Encryption    pkix.AlgorithmIdentifier
+}
+
+type pbkdf2Params struct {
+    Salt       []byte
+    Iterations int
+    KeyLength  int                      `asn1:"optional"`
+    PRF        pkix.AlgorithmIdentifier `asn1:"optional"`
+}
+
+// Decrypts an encrypted PKCS#8 key, returning the plain PKCS#8 DER. Only
+// PBES2 with PBKDF2 and AES or triple DES in CBC mode is supported, which
+// covers whatever openssl has made in the last decade.
+func decryptPKCS8(der []byte, passphrase string) ([]byte, error) {
+    info := encryptedPrivateKeyInfo{}
+    _, err := asn1.Unmarshal(der, &info)
+    if err != nil {
+        return nil, err
+    }
+    if !info.Algorithm.Algorithm.Equal(oidPBES2) {
+        return nil, errors.New(fmt.Sprintf("Unsupported encryption %s, only PBES2 is supported", info.Algorithm.Algorithm))
+    }
+
+    params := pbes2Params{}
+    _, err = asn1.Unmarshal(info.Algorithm.Parameters.FullBytes, &params)
+    if err != nil {
+        return nil, err
+    }
+    if !params.KeyDerivation.Algorithm.Equal(oidPBKDF2) {
+        return nil, errors.New(fmt.Sprintf("Unsupported key derivation %s, only PBKDF2 is supported", params.KeyDerivation.Algorithm))
+    }
+
+    kdf := pbkdf2Params{}
+    _, err = asn1.Unmarshal(params.KeyDerivation.Parameters.FullBytes, &kdf)
+    if err != nil {
+        return nil, err
+    }
+
+    // SHA-1 is the default when the key doesn't say.
+    var prf func() hash.Hash
+    switch {
+    case len(kdf.PRF.Algorithm) == 0 || kdf.PRF.Algorithm.Equal(oidHmacSHA1):
+        prf = sha1.New
+    case kdf.PRF.Algorithm.Equal(oidHmacSHA256):
+        prf = sha256.New
+    default:
+        return nil, errors.New(fmt.Sprintf("Unsupported PBKDF2 hash %s", kdf.PRF.Algorithm))
+    }
+
+    var newCipher func(key []byte) (cipher.Block, error)
+    var keyLength int
+    switch scheme := params.Encryption.Algorithm; {
+    case scheme.Equal(oidAES128CBC):
+        newCipher, keyLength = aes.NewCipher, 16
+    case scheme.Equal(oidAES192CBC):
+        newCipher, keyLength = aes.NewCipher, 24
+    case scheme.Equal(oidAES256CBC):
+        newCipher, keyLength = aes.NewCipher, 32
+    case scheme.Equal(oidDESEDE3CBC):
+        newCipher, keyLength = des.NewTripleDESCipher, 24
+    default:
+        return nil, errors.New(fmt.Sprintf("Unsupported cipher %s", scheme))
+    }
+
+    var iv []byte
+    _, err = asn1.Unmarshal(params.Encryption.Parameters.FullBytes, &iv)
+    if err != nil {
+        return nil, err
+    }
+
+    block, err := newCipher(pbkdf2.Key([]byte(passphrase), kdf.Salt, kdf.Iterations, keyLength, prf))
+    if err != nil {
+        return nil, err
+    }
+    size := block.BlockSize()
+    if len(iv) != size || len(info.Data) == 0 || len(info.Data)%size != 0 {
+        return nil, errors.New("Malformed encrypted key")
+    }
+
+    plain := make([]byte, len(info.Data))
+    cipher.NewCBCDecrypter(block, iv).CryptBlocks(plain, info.Data)
+
+    // A wrong passphrase shows up as bad padding, or failing that as
+    // something which isn't a key.
+    padding := int(plain[len(plain)-1])
+    if padding < 1 || padding > size {
+        return nil, errors.New("Wrong passphrase")
+    }
+    for _, b := range plain[len(plain)-padding:] {
+        if int(b) != padding {
+            return nil, errors.New("Wrong passphrase")
+        }
+    }
+    plain = plain[:len(plain)-padding]
+
+    _, err = x509.ParsePKCS8PrivateKey(plain)
+    if err != nil {
+        return nil, errors.New("Wrong passphrase")
+    }
+    return plain, nil
+}
@@ -0,0 +1,170 @@
+package gapless
+
+import (
+    "crypto/ecdsa"
+    "crypto/elliptic"
+    "crypto/rand"
+    "crypto/rsa"
+    "crypto/x509"
+    "crypto/x509/pkix"
+    "encoding/pem"
+    "github.com/cojac/assert"
+    "math/big"
+    "os"
+    "path/filepath"
+    "software.sslmate.com/src/go-pkcs12"
+    "testing"
+    "time"
+)
+
+func writeTestCert(t *testing.T, name string) ([]byte, string) {
+    key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+    if err != nil {
+        t.Fatalf("Generating key failed: %s", err)
+    }
+
+    tmpl := &x509.Certificate{
+        SerialNumber: big.NewInt(1),
+        Subject:      pkix.Name{CommonName: name},
+        NotBefore:    time.Now().Add(-time.Hour),
+        NotAfter:     time.Now().Add(time.Hour),
+    }
+    der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+    if err != nil {
+        t.Fatalf("Creating certificate failed: %s", err)
+    }
+
+    path := filepath.Join(t.TempDir(), name+".pem")
+    err = os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+    if err != nil {
+        t.Fatalf("Writing certificate failed: %s", err)
+    }
+
+    return der, path
+}
+
+func TestTlsConfigDefaults(t *testing.T) {
+    cfg, err := newApnsTlsConfig("api.push.apple.com:443", nil, tlsOptions{})
+    assert.Equal(t, nil, err)
+    assert.Equal(t, "api.push.apple.com", cfg.ServerName)
+    assert.Equal(t, false, cfg.InsecureSkipVerify)
+
+    _, err = newApnsTlsConfig("missing-port", nil, tlsOptions{})
+    assert.NotEqual(t, nil, err)
+}
+
+func TestTlsConfigCaBundle(t *testing.T) {
+    _, path := writeTestCert(t, "mock-ca")
+
+    cfg, err := newApnsTlsConfig("localhost:2195", nil, tlsOptions{caPath: path})
+    assert.Equal(t, nil, err)
+    assert.NotEqual(t, nil, cfg.RootCAs)
+
+    _, err = newApnsTlsConfig("localhost:2195", nil, tlsOptions{caPath: path + ".missing"})
+    assert.NotEqual(t, nil, err)
+}
+
+func TestTlsConfigPinned(t *testing.T) {
+    pinned, path := writeTestCert(t, "mock-server")
+    other, _ := writeTestCert(t, "someone-else")
+
+    cfg, err := newApnsTlsConfig("localhost:2195", nil, tlsOptions{pinnedPath: path})
+    assert.Equal(t, nil, err)
+    assert.Equal(t, true, cfg.InsecureSkipVerify)
+    assert.Equal(t, nil, cfg.VerifyPeerCertificate([][]byte{pinned}, nil))
+    assert.NotEqual(t, nil, cfg.VerifyPeerCertificate([][]byte{other}, nil))
+}
+
+func newTestKeyPair(t *testing.T) (*rsa.PrivateKey, *x509.Certificate) {
+    key, err := rsa.GenerateKey(rand.Reader, 2048)
+    if err != nil {
+        t.Fatalf("Generating key failed: %s", err)
+    }
+
+    tmpl := &x509.Certificate{
+        SerialNumber: big.NewInt(2),
+        Subject:      pkix.Name{CommonName: "Apple Push Services: com.example.app"},
+        NotBefore:    time.Now().Add(-time.Hour),
+        NotAfter:     time.Now().Add(time.Hour),
+    }
+    der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+    if err != nil {
+        t.Fatalf("Creating certificate failed: %s", err)
+    }
+
+    cert, _ := x509.ParseCertificate(der)
+    return key, cert
+}
+
+func TestLoadCertificateEncryptedPEM(t *testing.T) {
+    key, cert := newTestKeyPair(t)
+    dir := t.TempDir()
+
+    block, err := x509.EncryptPEMBlock(rand.Reader, "RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(key), []byte("hunter2"), x509.PEMCipherAES256)
+    if err != nil {
+        t.Fatalf("Encrypting key failed: %s", err)
+    }
+
+    // Cert and key in a single file.
+    combined := filepath.Join(dir, "combined.pem")
+    data := append(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw}), pem.EncodeToMemory(block)...)
+    _ = os.WriteFile(combined, data, 0600)
+
+    certs, err := loadApnsCertificate(combined, "", "hunter2")
+    assert.Equal(t, nil, err)
+    assert.Equal(t, 1, len(certs))
+
+    _, err = loadApnsCertificate(combined, "", "wrong")
+    assert.NotEqual(t, nil, err)
+
+    _, err = loadApnsCertificate(combined, "", "")
+    assert.NotEqual(t, nil, err)
+}
+
+// The keys in testdata are all the same one, as openssl writes it unencrypted,
+// encrypted with PKCS#8 (the default since OpenSSL 3) and in the legacy format.
+func TestLoadCertificateKeyFormats(t *testing.T) {
+    for _, name := range []string{"key-pkcs8-aes256.pem", "key-pkcs8-des3.pem", "key-legacy.pem"} {
+        key := filepath.Join("testdata", name)
+
+        certs, err := loadApnsCertificate("testdata/cert.pem", key, "hunter2")
+        assert.Equal(t, nil, err)
+        assert.Equal(t, 1, len(certs))
+
+        _, err = loadApnsCertificate("testdata/cert.pem", key, "wrong")
+        assert.NotEqual(t, nil, err)
+
+        _, err = loadApnsCertificate("testdata/cert.pem", key, "")
+        assert.NotEqual(t, nil, err)
+    }
+
+    certs, err := loadApnsCertificate("testdata/cert.pem", "testdata/key.pem", "")
+    assert.Equal(t, nil, err)
+    assert.Equal(t, 1, len(certs))
+}
+
+func TestLoadCertificatePKCS12(t *testing.T) {
+    key, cert := newTestKeyPair(t)
+
+    pfx, err := pkcs12.Modern.Encode(key, cert, nil, "hunter2")
+    if err != nil {
+        t.Fatalf("Encoding p12 failed: %s", err)
+    }
+
+    path := filepath.Join(t.TempDir(), "apns.p12")
+    _ = os.WriteFile(path, pfx, 0600)
+
+    certs, err := loadApnsCertificate(path, "", "hunter2")
+    assert.Equal(t, nil, err)
+    assert.Equal(t, 1, len(certs))
+    assert.Equal(t, cert.Raw, certs[0].Certificate[0])
+
+    _, err = loadApnsCertificate(path, "", "wrong")
+    assert.NotEqual(t, nil, err)
+}
+
+func TestLoadCertificateNone(t *testing.T) {
+    certs, err := loadApnsCertificate("", "", "")
+    assert.Equal(t, nil, err)
+    assert.Equal(t, 0, len(certs))
+}
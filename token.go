@@ -0,0 +1,122 @@
+package gapless
+
+import (
+    "crypto/ecdsa"
+    "crypto/rand"
+    "crypto/sha256"
+    "crypto/x509"
+    "encoding/base64"
+    "encoding/json"
+    "encoding/pem"
+    "errors"
+    "fmt"
+    "math/big"
+    "os"
+    "sync"
+    "time"
+)
+
+// Apple rejects provider tokens older than one hour, and also rejects them
+// if they are refreshed more often than every twenty minutes.
+const tokenRefreshInterval = 50 * time.Minute
+
+// Mints and caches the ES256 JWTs used for token based authentication.
+// A single signer is shared by every connection in the pool.
+type apnsTokenSigner struct {
+    key    *ecdsa.PrivateKey
+    keyId  string
+    teamId string
+    mu     sync.Mutex
+    token  string
+    issued time.Time
+}
+
+// loadApnsTokenSigner reads a .p8 signing key downloaded from Apple's portal.
+func loadApnsTokenSigner(path, keyId, teamId string) (*apnsTokenSigner, error) {
+    if keyId == "" || teamId == "" {
+        return nil, errors.New("Token authentication requires both a key ID and a team ID.")
+    }
+
+    raw, err := os.ReadFile(path)
+    if err != nil {
+        return nil, err
+    }
+
+    block, _ := pem.Decode(raw)
+    if block == nil {
+        return nil, errors.New(fmt.Sprintf("No PEM data found in signing key: %s", path))
+    }
+
+    parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+    if err != nil {
+        return nil, err
+    }
+
+    key, ok := parsed.(*ecdsa.PrivateKey)
+    if !ok {
+        return nil, errors.New(fmt.Sprintf("Signing key is not an ECDSA key: %s", path))
+    }
+
+    return &apnsTokenSigner{key: key, keyId: keyId, teamId: teamId}, nil
+}
+
+// Token returns the cached JWT, minting a new one when it is close to expiring.
+func (s *apnsTokenSigner) Token() (string, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    if s.token != "" && time.Since(s.issued) < tokenRefreshInterval {
+        return s.token, nil
+    }
+
+    now := time.Now()
+    token, err := s.sign(now)
+    if err != nil {
+        return "", err
+    }
+
+    s.token = token
+    s.issued = now
+    return token, nil
+}
+
+// Expire drops the cached token so the next call to Token mints a new one.
+// Used when Apple tells us the token has expired before we expected it to.
+func (s *apnsTokenSigner) Expire() {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    s.token = ""
+}
+
+func (s *apnsTokenSigner) sign(issued time.Time) (string, error) {
+    header, err := json.Marshal(map[string]string{"alg": "ES256", "kid": s.keyId})
+    if err != nil {
+        return "", err
+    }
+
+    claims, err := json.Marshal(map[string]interface{}{"iss": s.teamId, "iat": issued.Unix()})
+    if err != nil {
+        return "", err
+    }
+
+    unsigned := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+    digest := sha256.Sum256([]byte(unsigned))
+
+    r, sig, err := ecdsa.Sign(rand.Reader, s.key, digest[:])
+    if err != nil {
+        return "", err
+    }
+
+    // JWS wants the raw, fixed width r || s rather than ASN.1.
+    out := make([]byte, 64)
+    padInto(out[:32], r)
+    padInto(out[32:], sig)
+
+    return unsigned + "." + base64.RawURLEncoding.EncodeToString(out), nil
+}
+
+func padInto(dst []byte, n *big.Int) {
+    b := n.Bytes()
+    copy(dst[len(dst)-len(b):], b)
+}
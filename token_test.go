@@ -0,0 +1,98 @@
+package gapless
+
+import (
+    "crypto/ecdsa"
+    "crypto/elliptic"
+    "crypto/rand"
+    "crypto/sha256"
+    "crypto/x509"
+    "encoding/base64"
+    "encoding/json"
+    "encoding/pem"
+    "github.com/cojac/assert"
+    "math/big"
+    "os"
+    "path/filepath"
+    "strings"
+    "testing"
+    "time"
+)
+
+func writeTestSigningKey(t *testing.T) (*ecdsa.PrivateKey, string) {
+    key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+    if err != nil {
+        t.Fatalf("Generating key failed: %s", err)
+    }
+
+    der, err := x509.MarshalPKCS8PrivateKey(key)
+    if err != nil {
+        t.Fatalf("Marshalling key failed: %s", err)
+    }
+
+    path := filepath.Join(t.TempDir(), "AuthKey_TEST.p8")
+    err = os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600)
+    if err != nil {
+        t.Fatalf("Writing key failed: %s", err)
+    }
+
+    return key, path
+}
+
+func TestTokenSignerJwt(t *testing.T) {
+    key, path := writeTestSigningKey(t)
+
+    signer, err := loadApnsTokenSigner(path, "ABC123DEFG", "DEF123GHIJ")
+    assert.Equal(t, nil, err)
+
+    token, err := signer.Token()
+    assert.Equal(t, nil, err)
+
+    parts := strings.Split(token, ".")
+    assert.Equal(t, 3, len(parts))
+
+    header := make(map[string]interface{})
+    raw, _ := base64.RawURLEncoding.DecodeString(parts[0])
+    _ = json.Unmarshal(raw, &header)
+    assert.Equal(t, "ES256", header["alg"])
+    assert.Equal(t, "ABC123DEFG", header["kid"])
+
+    claims := make(map[string]interface{})
+    raw, _ = base64.RawURLEncoding.DecodeString(parts[1])
+    _ = json.Unmarshal(raw, &claims)
+    assert.Equal(t, "DEF123GHIJ", claims["iss"])
+
+    sig, _ := base64.RawURLEncoding.DecodeString(parts[2])
+    assert.Equal(t, 64, len(sig))
+
+    digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+    r := new(big.Int).SetBytes(sig[:32])
+    s := new(big.Int).SetBytes(sig[32:])
+    assert.Equal(t, true, ecdsa.Verify(&key.PublicKey, digest[:], r, s))
+}
+
+func TestTokenSignerCaching(t *testing.T) {
+    _, path := writeTestSigningKey(t)
+
+    signer, err := loadApnsTokenSigner(path, "ABC123DEFG", "DEF123GHIJ")
+    assert.Equal(t, nil, err)
+
+    first, _ := signer.Token()
+    second, _ := signer.Token()
+    assert.Equal(t, first, second)
+
+    // Pretend the token is almost an hour old.
+    signer.issued = time.Now().Add(-tokenRefreshInterval)
+    third, _ := signer.Token()
+    assert.NotEqual(t, first, third)
+
+    signer.Expire()
+    fourth, _ := signer.Token()
+    assert.NotEqual(t, third, fourth)
+}
+
+func TestTokenSignerMissingIds(t *testing.T) {
+    _, path := writeTestSigningKey(t)
+
+    _, err := loadApnsTokenSigner(path, "", "DEF123GHIJ")
+    assert.NotEqual(t, nil, err)
+}